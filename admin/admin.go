@@ -0,0 +1,221 @@
+package admin
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/httpCertif"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/httpjson"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/logger"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// DefaultListen address of the admin API, only reachable from the host itself
+const DefaultListen = "127.0.0.1:5003"
+
+// Server store the admin API server object. Used to shut down from outside context.
+var Server *http.Server
+
+// ShutdownChannel is a go chan that send to the main code a Shutdown signal
+var ShutdownChannel = make(chan string, 1)
+
+// ErrUnknownName is returned by a Controller asked about a certificate it does not manage
+var ErrUnknownName = errors.New("unknown certificate name")
+
+// Controller carries out the requests of the admin API on the certificates managed by the client.
+type Controller interface {
+	// Renew orders the certificate managed under name again and serves the new one
+	Renew(name string) error
+	// Revoke revokes the last certificate issued under name
+	Revoke(name string) error
+	// Status describes the client, encoded as the JSON answer of GET /status
+	Status() any
+}
+
+// Config configures the admin API. Requests must carry the bearer Token or a client certificate issued by ClientCAs.
+type Config struct {
+	// Listen is the host:port of the API
+	Listen string
+	// Token is the secret expected in the "Authorization: Bearer" header, none when empty
+	Token string
+	// ClientCAs enables mTLS: clients presenting a certificate of these CAs are authenticated. The API is then served
+	// over TLS with Certificate.
+	ClientCAs   *x509.CertPool
+	Certificate *tls.Certificate
+	// LegacyShutdown also accepts the unauthenticated GET /shutdown sent by the project testing environment
+	LegacyShutdown bool
+	Controller     Controller
+}
+
+// api serves the admin endpoints.
+type api struct {
+	cfg Config
+}
+
+// authorized tells whether r carries the bearer token or a verified client certificate.
+func (a *api) authorized(r *http.Request) bool {
+	if a.cfg.ClientCAs != nil && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	if a.cfg.Token == "" {
+		return false
+	}
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return found && subtle.ConstantTimeCompare([]byte(token), []byte(a.cfg.Token)) == 1
+}
+
+// authenticated only passes the authorized requests to next.
+func (a *api) authenticated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.authorized(r) {
+			logger.Logger().Warn().Msgf("Unauthenticated admin request %v %v from %v", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			httpjson.WriteError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (a *api) shutdown(w http.ResponseWriter, r *http.Request) {
+	logger.Logger().Debug().Msgf("Received a Shutdown signal from %v", r.RemoteAddr)
+
+	// Send a signal to the main code, a shutdown already pending is enough
+	select {
+	case ShutdownChannel <- "SleepySignal":
+	default:
+	}
+
+	if r.Method == http.MethodGet {
+		// The legacy endpoint answers with an empty body
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	httpjson.Write(w, http.StatusOK, map[string]string{"status": "shutting down"})
+}
+
+// control answers a renew or revoke request on the certificate of the {name} path value, done is the status of the
+// certificate once fn succeeded.
+func (a *api) control(action string, done string, fn func(string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		logger.Logger().Info().Msgf("Admin %v of %v requested by %v", action, name, r.RemoteAddr)
+
+		err := fn(name)
+		switch {
+		case errors.Is(err, ErrUnknownName):
+			httpjson.WriteError(w, http.StatusNotFound, err.Error())
+		case err != nil:
+			logger.Logger().Error().Msgf("Error while admin %v of %v: %v", action, name, err)
+			httpjson.WriteError(w, http.StatusInternalServerError, err.Error())
+		default:
+			httpjson.Write(w, http.StatusOK, map[string]string{"name": name, "status": done})
+		}
+	}
+}
+
+// handler routes the admin endpoints.
+func (a *api) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /shutdown", a.authenticated(a.shutdown))
+	mux.HandleFunc("POST /renew/{name}", a.authenticated(a.control("renew", "renewed", a.cfg.Controller.Renew)))
+	mux.HandleFunc("POST /revoke/{name}", a.authenticated(a.control("revoke", "revoked", a.cfg.Controller.Revoke)))
+	mux.HandleFunc("GET /certificates", a.authenticated(func(w http.ResponseWriter, _ *http.Request) {
+		httpjson.Write(w, http.StatusOK, httpCertif.Certificates.Status())
+	}))
+	mux.HandleFunc("GET /status", a.authenticated(func(w http.ResponseWriter, _ *http.Request) {
+		httpjson.Write(w, http.StatusOK, a.cfg.Controller.Status())
+	}))
+	if a.cfg.LegacyShutdown {
+		mux.HandleFunc("GET /shutdown", a.shutdown)
+	}
+	return mux
+}
+
+// tlsConfig returns the TLS configuration of the mTLS API. Clients may still authenticate with the token instead of a
+// certificate when one is configured.
+func (a *api) tlsConfig() *tls.Config {
+	clientAuth := tls.RequireAndVerifyClientCert
+	if a.cfg.Token != "" {
+		clientAuth = tls.VerifyClientCertIfGiven
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{*a.cfg.Certificate},
+		ClientAuth:   clientAuth,
+		ClientCAs:    a.cfg.ClientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// check validates cfg before the API is served.
+func check(cfg Config) error {
+	if cfg.Controller == nil {
+		return errors.New("no controller")
+	}
+	if cfg.Token == "" && cfg.ClientCAs == nil {
+		return errors.New("neither a token nor client CAs authenticate the requests")
+	}
+	if cfg.ClientCAs != nil && cfg.Certificate == nil {
+		return errors.New("mTLS needs a server certificate")
+	}
+	return nil
+}
+
+// Admin serves the admin API, the control plane of the running client.
+func Admin(cfg Config) {
+	if err := check(cfg); err != nil {
+		logger.Logger().Error().Msgf("Could not start admin server: %v", err)
+		return
+	}
+	a := &api{cfg: cfg}
+
+	Server = &http.Server{
+		Addr:    cfg.Listen,
+		Handler: a.handler(),
+	}
+	var err error
+	if cfg.ClientCAs != nil {
+		Server.TLSConfig = a.tlsConfig()
+		err = Server.ListenAndServeTLS("", "")
+	} else {
+		err = Server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Logger().Error().Msgf("Could not start admin server: %v", err)
+	}
+}
+
+// LoadOrGenerateToken reads the bearer token stored in path, or stores a new random one there readable by the owner
+// only.
+func LoadOrGenerateToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return "", fmt.Errorf("empty token in %v", path)
+		}
+		return token, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	logger.Logger().Info().Msgf("Generated admin token in %v", path)
+	return token, nil
+}
@@ -0,0 +1,142 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeController records the names it is asked to renew and revoke.
+type fakeController struct {
+	renewed, revoked []string
+}
+
+func (c *fakeController) Renew(name string) error {
+	if name != "example.com" {
+		return ErrUnknownName
+	}
+	c.renewed = append(c.renewed, name)
+	return nil
+}
+
+func (c *fakeController) Revoke(name string) error {
+	if name != "example.com" {
+		return ErrUnknownName
+	}
+	if len(c.revoked) > 0 {
+		return errors.New("certificate already revoked")
+	}
+	c.revoked = append(c.revoked, name)
+	return nil
+}
+
+func (c *fakeController) Status() any {
+	return map[string]int{"renewed": len(c.renewed)}
+}
+
+func request(h http.Handler, method string, path string, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAuthentication(t *testing.T) {
+	ctl := &fakeController{}
+	h := (&api{cfg: Config{Token: "secret", Controller: ctl}}).handler()
+
+	for _, path := range []string{"/status", "/certificates"} {
+		for _, token := range []string{"", "wrong", "secre"} {
+			if rec := request(h, http.MethodGet, path, token); rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("GET %v with token %q: %v", path, token, rec.Code)
+			}
+		}
+		if rec := request(h, http.MethodGet, path, "secret"); rec.Code != http.StatusOK {
+			t.Errorf("GET %v with the token: %v", path, rec.Code)
+		}
+	}
+	if rec := request(h, http.MethodPost, "/renew/example.com", ""); rec.Code != http.StatusUnauthorized || len(ctl.renewed) != 0 {
+		t.Errorf("Unauthenticated renewal: %v %v", rec.Code, ctl.renewed)
+	}
+
+	// The bare endpoint only exists in legacy mode
+	if rec := request(h, http.MethodGet, "/shutdown", ""); rec.Code != http.StatusMethodNotAllowed || len(ShutdownChannel) != 0 {
+		t.Errorf("Legacy shutdown accepted: %v", rec.Code)
+	}
+	if rec := request(h, http.MethodPost, "/shutdown", ""); rec.Code != http.StatusUnauthorized || len(ShutdownChannel) != 0 {
+		t.Errorf("Unauthenticated shutdown: %v", rec.Code)
+	}
+	if rec := request(h, http.MethodPost, "/shutdown", "secret"); rec.Code != http.StatusOK || len(ShutdownChannel) != 1 {
+		t.Errorf("Shutdown not signaled: %v", rec.Code)
+	}
+	// A second request does not block on the pending signal
+	if rec := request(h, http.MethodPost, "/shutdown", "secret"); rec.Code != http.StatusOK {
+		t.Errorf("Second shutdown: %v", rec.Code)
+	}
+	<-ShutdownChannel
+
+	legacy := (&api{cfg: Config{Token: "secret", LegacyShutdown: true, Controller: ctl}}).handler()
+	if rec := request(legacy, http.MethodGet, "/shutdown", ""); rec.Code != http.StatusOK || len(ShutdownChannel) != 1 {
+		t.Errorf("Legacy shutdown refused: %v", rec.Code)
+	}
+	<-ShutdownChannel
+	if rec := request(legacy, http.MethodGet, "/status", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Legacy mode opened the status: %v", rec.Code)
+	}
+}
+
+func TestControl(t *testing.T) {
+	ctl := &fakeController{}
+	h := (&api{cfg: Config{Token: "secret", Controller: ctl}}).handler()
+
+	if rec := request(h, http.MethodPost, "/renew/example.com", "secret"); rec.Code != http.StatusOK || len(ctl.renewed) != 1 {
+		t.Errorf("Renewal: %v %q", rec.Code, rec.Body)
+	}
+	if rec := request(h, http.MethodPost, "/renew/other.org", "secret"); rec.Code != http.StatusNotFound {
+		t.Errorf("Renewal of an unknown name: %v", rec.Code)
+	}
+	if rec := request(h, http.MethodGet, "/renew/example.com", "secret"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Renewal with GET: %v", rec.Code)
+	}
+
+	if rec := request(h, http.MethodPost, "/revoke/example.com", "secret"); rec.Code != http.StatusOK {
+		t.Errorf("Revocation: %v %q", rec.Code, rec.Body)
+	}
+	if rec := request(h, http.MethodPost, "/revoke/example.com", "secret"); rec.Code != http.StatusInternalServerError {
+		t.Errorf("Second revocation: %v", rec.Code)
+	}
+
+	rec := request(h, http.MethodGet, "/status", "secret")
+	if rec.Code != http.StatusOK || rec.Body.String() != "{\"renewed\":1}\n" {
+		t.Errorf("Wrong status: %v %q", rec.Code, rec.Body)
+	}
+}
+
+func TestLoadOrGenerateToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.token")
+
+	token, err := LoadOrGenerateToken(path)
+	if err != nil || len(token) < 32 {
+		t.Fatalf("Generated token %q: %v", token, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Token file not private: %v %v", info, err)
+	}
+	if again, err := LoadOrGenerateToken(path); err != nil || again != token {
+		t.Errorf("Stored token not reused: %q %v", again, err)
+	}
+
+	if err := os.WriteFile(path, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadOrGenerateToken(path); err == nil {
+		t.Errorf("Empty token accepted")
+	}
+}
@@ -0,0 +1,202 @@
+package caa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/dnsquery"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Property tags of RFC 8659
+const (
+	TagIssue     = "issue"
+	TagIssueWild = "issuewild"
+	TagIodef     = "iodef"
+)
+
+// flagCritical is the issuer critical flag of a CAA record
+const flagCritical = 128
+
+// Issuer is the parsed value of an issue or issuewild property.
+type Issuer struct {
+	// Domain of the CA allowed to issue, empty when issuance is forbidden
+	Domain string
+	// Parameters such as accounturi and validationmethods (RFC 8657), keyed by lower case name
+	Parameters map[string]string
+}
+
+// normalize returns domain lower case, without surrounding spaces nor trailing dot, as the issuer domains are compared.
+func normalize(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+// allowsMethod tells whether the comma separated validationmethods parameter lists method.
+func allowsMethod(methods string, method string) bool {
+	for _, m := range strings.Split(methods, ",") {
+		if strings.EqualFold(strings.TrimSpace(m), method) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseIssuer parses the value of an issue or issuewild property, e.g. "ca.example; accounturi=https://...".
+func ParseIssuer(value string) (Issuer, error) {
+	parts := strings.Split(value, ";")
+	issuer := Issuer{
+		Domain:     normalize(parts[0]),
+		Parameters: make(map[string]string),
+	}
+
+	for _, part := range parts[1:] {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, val, found := strings.Cut(part, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		if !found || key == "" {
+			return Issuer{}, fmt.Errorf("invalid CAA parameter %q", part)
+		}
+		issuer.Parameters[key] = strings.TrimSpace(val)
+	}
+
+	return issuer, nil
+}
+
+// NewRecord builds a CAA record for name, checking that issue and issuewild values parse.
+func NewRecord(name string, flag uint8, tag string, value string) (*dns.CAA, error) {
+	tag = strings.ToLower(tag)
+	switch tag {
+	case TagIssue, TagIssueWild:
+		if _, err := ParseIssuer(value); err != nil {
+			return nil, err
+		}
+	case TagIodef:
+		if !strings.HasPrefix(value, "mailto:") && !strings.HasPrefix(value, "https://") && !strings.HasPrefix(value, "http://") {
+			return nil, fmt.Errorf("invalid iodef URL %q", value)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported CAA tag %q", tag)
+	}
+
+	return &dns.CAA{
+		Hdr:   dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeCAA, Class: dns.ClassINET, Ttl: 3600},
+		Flag:  flag,
+		Tag:   tag,
+		Value: value,
+	}, nil
+}
+
+// Lookup finds the relevant CAA RRset of domain by climbing the DNS tree (RFC 8659 section 3) with the recursive
+// resolver at server. It returns the records and the name they were found at, no records means no restriction.
+func Lookup(ctx context.Context, server string, domain string) ([]*dns.CAA, string, error) {
+	name := dns.Fqdn(strings.ToLower(strings.TrimPrefix(domain, "*.")))
+	client := new(dns.Client)
+
+	// dns.Split does not return the root, where the tree climbing stops
+	for _, i := range dns.Split(name) {
+		records, err := query(ctx, client, server, name[i:])
+		if err != nil {
+			return nil, "", err
+		}
+		if len(records) > 0 {
+			return records, name[i:], nil
+		}
+	}
+
+	return nil, "", nil
+}
+
+// query returns the CAA records of name, following CNAMEs.
+func query(ctx context.Context, client *dns.Client, server string, name string) ([]*dns.CAA, error) {
+	rrs, _, err := dnsquery.Follow(ctx, client, server, name, dns.TypeCAA)
+	if err != nil {
+		return nil, fmt.Errorf("CAA lookup of %v failed: %w", name, err)
+	}
+	var records []*dns.CAA
+	for _, rr := range rrs {
+		records = append(records, rr.(*dns.CAA))
+	}
+	return records, nil
+}
+
+// Request describes the issuance checked against the CAA records.
+type Request struct {
+	// Identifier requested in the order, wildcards as *.example.com
+	Identifier string
+	// CAAIdentities are the issuer domains of the CA (directory meta.caaIdentities)
+	CAAIdentities []string
+	// AccountURI is the URL of the ACME account
+	AccountURI string
+	// ValidationMethod is the ACME challenge type used for the identifier
+	ValidationMethod string
+}
+
+// Check evaluates the relevant CAA records for req and returns why the CA would refuse to issue, nil when issuance is
+// allowed.
+func Check(records []*dns.CAA, req Request) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	wildcard := strings.HasPrefix(req.Identifier, "*.")
+
+	var issue, issueWild []*dns.CAA
+	for _, rr := range records {
+		switch strings.ToLower(rr.Tag) {
+		case TagIssue:
+			issue = append(issue, rr)
+		case TagIssueWild:
+			issueWild = append(issueWild, rr)
+		case TagIodef:
+		default:
+			if rr.Flag&flagCritical != 0 {
+				return fmt.Errorf("unknown critical CAA property %q", rr.Tag)
+			}
+		}
+	}
+
+	// issuewild takes precedence for wildcard identifiers (RFC 8659 section 4.3)
+	properties := issue
+	if wildcard && len(issueWild) > 0 {
+		properties = issueWild
+	}
+	if len(properties) == 0 {
+		return nil
+	}
+
+	if len(req.CAAIdentities) == 0 {
+		return errors.New("the ACME server does not advertise caaIdentities, CAA records cannot be checked")
+	}
+
+	var reasons []string
+	for _, rr := range properties {
+		issuer, err := ParseIssuer(rr.Value)
+		if err != nil {
+			reasons = append(reasons, err.Error())
+			continue
+		}
+		if issuer.Domain == "" || !slices.ContainsFunc(req.CAAIdentities, func(id string) bool { return normalize(id) == issuer.Domain }) {
+			continue
+		}
+		if uri, ok := issuer.Parameters["accounturi"]; ok && uri != req.AccountURI {
+			reasons = append(reasons, fmt.Sprintf("%v is restricted to account %v", issuer.Domain, uri))
+			continue
+		}
+		if methods, ok := issuer.Parameters["validationmethods"]; ok && !allowsMethod(methods, req.ValidationMethod) {
+			reasons = append(reasons, fmt.Sprintf("%v is restricted to validation methods %v", issuer.Domain, methods))
+			continue
+		}
+		return nil
+	}
+
+	if len(reasons) == 0 {
+		return fmt.Errorf("none of the CA identities %v is authorized", req.CAAIdentities)
+	}
+	return errors.New(strings.Join(reasons, ", "))
+}
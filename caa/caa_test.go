@@ -0,0 +1,166 @@
+package caa
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseIssuer(t *testing.T) {
+	tests := []struct {
+		value  string
+		domain string
+		params map[string]string
+		err    bool
+	}{
+		{value: "ca.example", domain: "ca.example"},
+		{value: " CA.Example. ", domain: "ca.example"},
+		{value: ";", domain: ""},
+		{value: "ca.example; AccountURI=https://ca.example/acct/1 ; validationmethods=dns-01,http-01", domain: "ca.example",
+			params: map[string]string{"accounturi": "https://ca.example/acct/1", "validationmethods": "dns-01,http-01"}},
+		{value: "ca.example; novalue", err: true},
+		{value: "ca.example; =x", err: true},
+	}
+	for _, tt := range tests {
+		issuer, err := ParseIssuer(tt.value)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseIssuer(%q) error: %v", tt.value, err)
+			continue
+		}
+		if tt.err {
+			continue
+		}
+		if issuer.Domain != tt.domain || len(issuer.Parameters) != len(tt.params) {
+			t.Errorf("ParseIssuer(%q) = %+v", tt.value, issuer)
+		}
+		for k, v := range tt.params {
+			if issuer.Parameters[k] != v {
+				t.Errorf("ParseIssuer(%q) parameter %v = %q, expected %q", tt.value, k, issuer.Parameters[k], v)
+			}
+		}
+	}
+}
+
+func caaRecord(flag uint8, tag string, value string) *dns.CAA {
+	return &dns.CAA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeCAA, Class: dns.ClassINET}, Flag: flag, Tag: tag, Value: value}
+}
+
+func TestCheck(t *testing.T) {
+	req := Request{
+		Identifier:       "www.example.com",
+		CAAIdentities:    []string{"CA.Example."},
+		AccountURI:       "https://ca.example/acct/1",
+		ValidationMethod: "http-01",
+	}
+	wildcard := req
+	wildcard.Identifier = "*.example.com"
+
+	tests := []struct {
+		name    string
+		records []*dns.CAA
+		req     Request
+		allowed bool
+	}{
+		{name: "no records", req: req, allowed: true},
+		{name: "issue", records: []*dns.CAA{caaRecord(0, TagIssue, "ca.example")}, req: req, allowed: true},
+		{name: "other CA", records: []*dns.CAA{caaRecord(0, TagIssue, "other.ca")}, req: req},
+		{name: "forbidden", records: []*dns.CAA{caaRecord(0, TagIssue, ";")}, req: req},
+		{name: "iodef only", records: []*dns.CAA{caaRecord(0, TagIodef, "mailto:a@example.com")}, req: req, allowed: true},
+		{name: "issuewild ignored for non wildcard", records: []*dns.CAA{
+			caaRecord(0, TagIssue, "ca.example"), caaRecord(0, TagIssueWild, ";")}, req: req, allowed: true},
+		{name: "issuewild precedence", records: []*dns.CAA{
+			caaRecord(0, TagIssue, "ca.example"), caaRecord(0, TagIssueWild, ";")}, req: wildcard},
+		{name: "issuewild allows", records: []*dns.CAA{
+			caaRecord(0, TagIssue, ";"), caaRecord(0, TagIssueWild, "ca.example")}, req: wildcard, allowed: true},
+		{name: "issue applies to wildcard", records: []*dns.CAA{caaRecord(0, TagIssue, "ca.example")}, req: wildcard, allowed: true},
+		{name: "unknown critical tag", records: []*dns.CAA{
+			caaRecord(0, TagIssue, "ca.example"), caaRecord(flagCritical, "tbs", "x")}, req: req},
+		{name: "unknown tag", records: []*dns.CAA{
+			caaRecord(0, TagIssue, "ca.example"), caaRecord(0, "tbs", "x")}, req: req, allowed: true},
+		{name: "accounturi", records: []*dns.CAA{caaRecord(0, TagIssue, "ca.example; accounturi=https://ca.example/acct/1")}, req: req, allowed: true},
+		{name: "other accounturi", records: []*dns.CAA{caaRecord(0, TagIssue, "ca.example; accounturi=https://ca.example/acct/2")}, req: req},
+		{name: "validationmethods", records: []*dns.CAA{caaRecord(0, TagIssue, "ca.example; validationmethods=dns-01, http-01")}, req: req, allowed: true},
+		{name: "other validationmethods", records: []*dns.CAA{caaRecord(0, TagIssue, "ca.example; validationmethods=dns-01")}, req: req},
+		{name: "second property allows", records: []*dns.CAA{
+			caaRecord(0, TagIssue, "ca.example; validationmethods=dns-01"), caaRecord(0, TagIssue, "ca.example")}, req: req, allowed: true},
+	}
+	for _, tt := range tests {
+		if err := Check(tt.records, tt.req); (err == nil) != tt.allowed {
+			t.Errorf("%v: Check = %v, expected allowed %v", tt.name, err, tt.allowed)
+		}
+	}
+
+	noIdentities := req
+	noIdentities.CAAIdentities = nil
+	if err := Check([]*dns.CAA{caaRecord(0, TagIssue, "ca.example")}, noIdentities); err == nil {
+		t.Errorf("Check without caaIdentities succeeded")
+	}
+}
+
+// startResolver serves records as a recursive resolver that does not follow CNAMEs itself.
+func startResolver(t *testing.T, records map[string][]dns.RR) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg).SetReply(r)
+		name := strings.ToLower(r.Question[0].Name)
+		if name == "fail.example.com." {
+			m.Rcode = dns.RcodeServerFailure
+		}
+		m.Answer = records[name]
+		_ = w.WriteMsg(m)
+	})
+	server := &dns.Server{PacketConn: pc, Handler: handler}
+	go func() { _ = server.ActivateAndServe() }()
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestLookup(t *testing.T) {
+	cname := func(name, target string) dns.RR {
+		return &dns.CNAME{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET}, Target: target}
+	}
+	apex := caaRecord(0, TagIssue, "ca.example")
+	target := caaRecord(0, TagIssue, "other.ca")
+	target.Hdr.Name = "target.example.net."
+	server := startResolver(t, map[string][]dns.RR{
+		"example.com.":        {apex},
+		"alias.example.org.":  {cname("alias.example.org.", "target.example.net.")},
+		"target.example.net.": {target},
+		"a.loop.example.":     {cname("a.loop.example.", "a.loop.example.")},
+	})
+
+	tests := []struct {
+		domain string
+		owner  string
+		value  string
+		err    bool
+	}{
+		{domain: "example.com", owner: "example.com.", value: "ca.example"},
+		{domain: "a.b.WWW.example.com", owner: "example.com.", value: "ca.example"},
+		{domain: "*.example.com", owner: "example.com.", value: "ca.example"},
+		{domain: "alias.example.org", owner: "alias.example.org.", value: "other.ca"},
+		{domain: "www.alias.example.org", owner: "alias.example.org.", value: "other.ca"},
+		{domain: "unrestricted.example.net", owner: ""},
+		{domain: "fail.example.com", err: true},
+		{domain: "a.loop.example", err: true},
+	}
+	for _, tt := range tests {
+		records, owner, err := Lookup(context.Background(), server, tt.domain)
+		if (err != nil) != tt.err {
+			t.Errorf("Lookup(%v) error: %v", tt.domain, err)
+			continue
+		}
+		if tt.err {
+			continue
+		}
+		if owner != tt.owner || (tt.value == "" && len(records) > 0) || (tt.value != "" && (len(records) != 1 || records[0].Value != tt.value)) {
+			t.Errorf("Lookup(%v) = %v at %q", tt.domain, records, owner)
+		}
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"crypto/x509"
 	"encoding/json"
 	"errors"
-	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/crypto"
 	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/logger"
 	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/network"
 	"io"
@@ -20,7 +19,9 @@ type accountRequest struct {
 	Contact              []string `json:"contact"`
 }
 
-func createAccount(url string, nonce string, certPool *x509.CertPool) (string, string, *ecdsa.PrivateKey, error) {
+// createAccount registers pKey at the ACME server, or looks up the existing account of pKey.
+// It returns the next nonce and the account URL (kid).
+func createAccount(url string, nonce string, certPool *x509.CertPool, pKey *ecdsa.PrivateKey) (string, string, error) {
 
 	payload := accountRequest{
 		TermsOfServiceAgreed: true,
@@ -29,7 +30,7 @@ func createAccount(url string, nonce string, certPool *x509.CertPool) (string, s
 
 	jsonPayload, err := json.Marshal(payload)
 	if err != nil {
-		return "", "", nil, err
+		return "", "", err
 	}
 
 	tr := &http.Transport{
@@ -38,14 +39,9 @@ func createAccount(url string, nonce string, certPool *x509.CertPool) (string, s
 
 	httpClient := http.Client{Transport: tr}
 
-	pKey, err := crypto.GenerateNewKeys()
-	if err != nil {
-		return "", "", nil, err
-	}
-
 	myjws, err := network.NewJWS(nonce, url, pKey, jsonPayload, "")
 	if err != nil {
-		return "", "", nil, err
+		return "", "", err
 	}
 
 	myjws.EncodedSignature = strings.Replace(myjws.EncodedSignature, "=", "", -1)
@@ -53,7 +49,7 @@ func createAccount(url string, nonce string, certPool *x509.CertPool) (string, s
 
 	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(myjson))
 	if err != nil {
-		return "", "", nil, err
+		return "", "", err
 	}
 
 	req.Header.Set("Content-Type", "application/jose+json")
@@ -62,21 +58,21 @@ func createAccount(url string, nonce string, certPool *x509.CertPool) (string, s
 	res, err := httpClient.Do(req)
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		return "", "", nil, err
+		return "", "", err
 	}
 
 	logger.Logger().Debug().Msgf("\nRES:" + string(body) + "\n")
 	if err != nil {
-		return "", "", nil, err
+		return "", "", err
 	}
 
 	if res.Header.Get("Replay-Nonce") == "" {
-		return "", "", nil, errors.New("no Replay-Nonce")
+		return "", "", errors.New("no Replay-Nonce")
 	}
 
 	if res.Header.Get("Location") == "" {
-		return "", "", nil, errors.New("no Location")
+		return "", "", errors.New("no Location")
 	}
 
-	return res.Header.Get("Replay-Nonce"), res.Header.Get("Location"), pKey, nil
+	return res.Header.Get("Replay-Nonce"), res.Header.Get("Location"), nil
 }
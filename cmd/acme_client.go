@@ -4,33 +4,67 @@ import (
 	"context"
 	"crypto/ecdsa"
 	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
-	"encoding/pem"
 	"flag"
-	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/httpShutdown"
+	"fmt"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/admin"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/crypto"
 	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/logger"
 	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/network"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/propagation"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/rfc2136"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/solver"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/webroot"
 	"log"
 	"log/slog"
+	"net"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/miekg/dns"
 	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/dns01"
 	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/http01"
 	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/httpCertif"
 )
 
+// Commands selected by the first positional argument, a challenge type selects commandIssue
+const (
+	commandIssue       = "issue"
+	commandAuthorize   = "authorize"
+	commandDeauthorize = "deauthorize"
+	commandDNSLog      = "dns-log"
+)
+
 func main() {
-	// Positional argument must be either dns01 or http01
+	// Positional argument must be either dns01, http01 or a command
 	if len(os.Args) < 2 {
-		log.Fatal("Challenge type (required): {dns01 | http01}")
+		log.Fatal("Challenge type or command (required): {dns01 | http01 | authorize | deauthorize | dns-log}")
 	}
 
-	// Get the Challenge type
+	// Get the command and the Challenge type, issuing a certificate is the default command
+	command := commandIssue
 	challengeType := os.Args[1]
-	if challengeType != "dns01" && challengeType != "http01" {
+	flagArgs := os.Args[2:]
+	switch os.Args[1] {
+	case commandAuthorize:
+		if len(os.Args) < 3 {
+			log.Fatal("Challenge type (required): authorize {dns01 | http01}")
+		}
+		command, challengeType, flagArgs = commandAuthorize, os.Args[2], os.Args[3:]
+	case commandDeauthorize:
+		command, challengeType = commandDeauthorize, ""
+	case commandDNSLog:
+		// Reading a capture does not talk to the ACME server
+		dnsLog(os.Args[2:])
+		return
+	}
+
+	if command != commandDeauthorize && challengeType != "dns01" && challengeType != "http01" {
 		log.Fatalf("Invalid challenge type: %s. Must be either dns01 or http01", challengeType)
 	}
 
@@ -40,7 +74,37 @@ func main() {
 	// Define the flags within this FlagSet
 	dirURL := flags.String("dir", "", "ACME server directory URL (required)")
 	ipv4Address := flags.String("record", "", "Returned IPv4 for A-record queries (required)")
+	ipv6Address := flags.String("record6", "", "Returned IPv6 for AAAA-record queries (optional)")
 	revoke := flags.Bool("revoke", false, "Revoke the certificate after obtaining it (optional; default false)")
+	csrFile := flags.String("csr", "", "PEM encoded CSR used unchanged to finalize the order; its identifiers define the order (optional)")
+	reuseKey := flags.Bool("reuse-key", false, "Reuse the private key stored in --key-file across renewals (optional; default false)")
+	keyFile := flags.String("key-file", "certificate.key", "Location of the certificate private key used by --reuse-key (optional)")
+	certOut := flags.String("cert-out", "", "Write the downloaded certificate chain to this file (optional)")
+	subject := flags.String("subject", "", "CSR subject as comma separated attributes, e.g. \"C=CH,O=Org,CN=example.com\" (optional; default CN=first domain,C=CH)")
+	emptySubject := flags.Bool("empty-subject", false, "Leave the CSR subject empty and only use SANs (optional; default false)")
+	mustStaple := flags.Bool("must-staple", false, "Request the OCSP Must-Staple TLS Feature extension (optional; default false)")
+	ocspStaple := flags.Bool("ocsp-staple", false, "Staple OCSP responses to the served certificate, Must-Staple certificates are always stapled (optional; default false)")
+	ocspResponder := flags.String("ocsp-responder", "", "OCSP responder URL used instead of the one of the certificate, e.g. a local stand-in (optional)")
+	tlsMinVersion := flags.String("tls-min-version", "", "Minimum TLS version of the certificate server: 1.0, 1.1, 1.2 or 1.3 (optional; default Go default)")
+	tlsCiphers := flags.String("tls-ciphers", "", "Comma separated TLS 1.2 cipher suites of the certificate server, e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 (optional; default Go default)")
+	tlsCurves := flags.String("tls-curves", "", "Comma separated key exchange curves of the certificate server in preference order: X25519, P-256, P-384, P-521 (optional; default Go default)")
+	tlsDisableHTTP2 := flags.Bool("tls-disable-http2", false, "Only offer HTTP/1.1 on the certificate server (optional; default false)")
+	tlsHSTS := flags.Duration("tls-hsts", 0, "max-age of the Strict-Transport-Security header of the certificate server, e.g. 8760h (optional; default no header)")
+	tlsHSTSSubdomains := flags.Bool("tls-hsts-subdomains", false, "Add includeSubDomains to the Strict-Transport-Security header (optional; default false)")
+	tlsClientCA := flags.String("tls-client-ca", "", "PEM file of the CAs whose client certificates the certificate server requires (optional; default no client authentication)")
+	accountKeyFile := flags.String("account-key", "", "Load the account key from this file, or store a new one there (optional; default fresh key)")
+
+	// Handle multiple --eku flags, each one may also be a comma separated list
+	var extKeyUsage []string
+	flags.Func("eku", "Extended key usage to request in the CSR: serverAuth, clientAuth, ... (optional, can be multiple)", func(usage string) error {
+		for _, u := range strings.Split(usage, ",") {
+			if _, ok := extKeyUsages[strings.TrimSpace(u)]; !ok {
+				return fmt.Errorf("unknown extended key usage %q", u)
+			}
+			extKeyUsage = append(extKeyUsage, strings.TrimSpace(u))
+		}
+		return nil
+	})
 
 	// Handle multiple --domain flags
 	var domainList []string
@@ -49,8 +113,155 @@ func main() {
 		return nil
 	})
 
-	// Parse keyword argument flags (starting from the second argument since the first is a positional argument)
-	err := flags.Parse(os.Args[2:])
+	// Handle multiple --challenge-for flags
+	perDomainChallenge := make(map[string]string)
+	flags.Func("challenge-for", "Challenge type of one identifier as DOMAIN=TYPE, e.g. *.example.com=dns01 (optional, can be multiple; default positional challenge type)", func(value string) error {
+		domain, name, found := strings.Cut(value, "=")
+		challengeType := solver.ChallengeType(name)
+		if !found || domain == "" || challengeType == "" {
+			return fmt.Errorf("invalid challenge selection %q, expected DOMAIN={dns01 | http01}", value)
+		}
+		perDomainChallenge[domain] = challengeType
+		return nil
+	})
+
+	// Handle multiple --zone flags
+	var zoneList []*dns01.Zone
+	flags.Func("zone", "Zone served authoritatively by the DNS server as [ORIGIN=]FILE, an RFC 1035 zone file (optional, can be multiple)", func(value string) error {
+		origin, file, found := strings.Cut(value, "=")
+		if !found {
+			origin, file = "", value
+		}
+		zone, err := dns01.LoadZone(file, origin)
+		if err != nil {
+			return err
+		}
+		zoneList = append(zoneList, zone)
+		return nil
+	})
+
+	// Handle multiple --address flags
+	hostAddresses := make(map[string][]net.IP)
+	flags.Func("address", "Address returned for one name as NAME=IP, IPv4 for A and IPv6 for AAAA queries (optional, can be multiple)", func(value string) error {
+		name, addr, found := strings.Cut(value, "=")
+		ip := net.ParseIP(addr)
+		if !found || name == "" || ip == nil {
+			return fmt.Errorf("invalid address %q, expected NAME=IP", value)
+		}
+		hostAddresses[name] = append(hostAddresses[name], ip)
+		return nil
+	})
+
+	// Handle multiple --delegate flags
+	delegations := make(map[string]string)
+	flags.Func("delegate", "Delegation of the _acme-challenge name of one identifier as DOMAIN=TARGET, the DNS server answers it with a CNAME to TARGET and serves the TXT records there (optional, can be multiple)", func(value string) error {
+		domain, target, found := strings.Cut(value, "=")
+		if !found || domain == "" || target == "" {
+			return fmt.Errorf("invalid delegation %q, expected DOMAIN=TARGET", value)
+		}
+		delegations[domain] = target
+		return nil
+	})
+
+	acmeDNSListen := flags.String("acmedns-listen", "", "Address HOST:PORT of the acme-dns compatible API letting remote clients publish their dns-01 records (optional; default disabled)")
+	acmeDNSDomain := flags.String("acmedns-domain", "", "Domain under which the DNS server serves the acme-dns registrations (required by --acmedns-listen)")
+	acmeDNSStorage := flags.String("acmedns-storage", "acmedns.json", "File keeping the acme-dns registrations and their credentials (optional)")
+
+	adminListen := flags.String("admin-listen", admin.DefaultListen, "Address HOST:PORT of the admin API: shutdown, renew, revoke and status of the client (optional)")
+	adminTokenFile := flags.String("admin-token-file", "admin.token", "File holding the bearer token of the admin API, a random one is stored there when missing (optional)")
+	adminClientCA := flags.String("admin-client-ca", "", "PEM file of the CAs whose client certificates authenticate to the admin API, served over TLS then (optional; default bearer token only)")
+	adminTLSCert := flags.String("admin-tls-cert", "", "PEM certificate chain of the admin API over TLS (required by --admin-client-ca)")
+	adminTLSKey := flags.String("admin-tls-key", "", "PEM private key of --admin-tls-cert (required by --admin-client-ca)")
+	adminLegacyShutdown := flags.Bool("admin-legacy-shutdown", false, "Also accept an unauthenticated GET /shutdown, as sent by the project testing environment and enabled by project/run (optional; default false)")
+
+	// Handle multiple --caa flags
+	var caaList []*dns.CAA
+	flags.Func("caa", "CAA record served by the DNS server as NAME=TAG:VALUE, e.g. example.com=issue:ca.example; validationmethods=dns-01 (optional, can be multiple)", func(value string) error {
+		rr, err := parseCAAFlag(value)
+		if err != nil {
+			return err
+		}
+		caaList = append(caaList, rr)
+		return nil
+	})
+	caaCheck := flags.Bool("caa-check", false, "Check the CAA records of every identifier before creating the order (optional; default false)")
+	caaResolver := flags.String("caa-resolver", "", "Recursive resolver HOST:PORT used by --caa-check (optional; default first name server of /etc/resolv.conf)")
+
+	// Handle multiple --dnssec-zone flags
+	var dnssecZones []string
+	flags.Func("dnssec-zone", "Zone whose answers the DNS server signs with DNSSEC (optional, can be multiple)", func(zone string) error {
+		dnssecZones = append(dnssecZones, zone)
+		return nil
+	})
+	dnssecKeys := flags.String("dnssec-keys", "dnssec", "Directory of the DNSSEC key files, missing keys are generated there with the DS records (optional)")
+	dnssecAlgorithm := flags.String("dnssec-algorithm", "ecdsap256sha256", "Algorithm of the generated DNSSEC keys: ecdsap256sha256 or ed25519 (optional)")
+	dnssecNSEC3 := flags.Bool("dnssec-nsec3", false, "Deny existence with NSEC3 instead of compact NSEC records (optional; default false)")
+
+	// Handle multiple --dns-listen flags
+	var dnsListeners []dns01.Listener
+	flags.Func("dns-listen", "Address of the DNS server as NET:HOST:PORT, e.g. tcp:[::]:10053 (optional, can be multiple; default udp and tcp on 0.0.0.0:10053)", func(value string) error {
+		l, err := dns01.ParseListener(value)
+		if err != nil {
+			return err
+		}
+		dnsListeners = append(dnsListeners, l)
+		return nil
+	})
+
+	rfc2136Server := flags.String("rfc2136-server", "", "Primary name server HOST:PORT answering dns-01 challenges with RFC 2136 dynamic updates (optional; default built-in DNS server)")
+	rfc2136Zone := flags.String("rfc2136-zone", "", "Zone receiving the RFC 2136 updates (optional; default found with an SOA query to --rfc2136-server)")
+	rfc2136Resolver := flags.String("rfc2136-resolver", "", "Recursive resolver HOST:PORT following the CNAME delegation of the _acme-challenge names before updating (optional; default no delegation)")
+	rfc2136TSIG := flags.String("rfc2136-tsig", "", "TSIG key signing the RFC 2136 updates as [ALGORITHM:]NAME:SECRET, ALGORITHM is hmac-sha256 or hmac-sha512 (optional; default unsigned)")
+	rfc2136Timeout := flags.Duration("rfc2136-timeout", rfc2136.DefaultPropagationTimeout, "Maximum wait for the primary to serve an updated record (optional)")
+
+	propagationCheck := flags.Bool("propagation-check", false, "Wait until every authoritative name server serves the dns-01 TXT record before triggering validation (optional; default false)")
+	propagationResolver := flags.String("propagation-resolver", "", "Recursive resolver HOST:PORT used by --propagation-check to find the authoritative name servers (optional; default first name server of /etc/resolv.conf)")
+	propagationTimeout := flags.Duration("propagation-timeout", propagation.DefaultTimeout, "Maximum wait of --propagation-check for one record (optional)")
+
+	// Handle multiple --propagation-nameserver flags
+	var propagationNameservers []string
+	flags.Func("propagation-nameserver", "Name server HOST:PORT queried by --propagation-check instead of the authoritative ones (optional, can be multiple)", func(server string) error {
+		propagationNameservers = append(propagationNameservers, server)
+		return nil
+	})
+
+	// Handle multiple --webroot flags
+	webroots := webroot.Solver{PerDomain: make(map[string]string)}
+	flags.Func("webroot", "Document root of a web server serving the http-01 challenge files, as [DOMAIN=]PATH, instead of the built-in server (optional, can be multiple)", func(value string) error {
+		domain, path, err := webroot.ParseWebroot(value)
+		if err != nil {
+			return err
+		}
+		if domain == "" {
+			webroots.Default = path
+		} else {
+			webroots.PerDomain[domain] = path
+		}
+		return nil
+	})
+	http01Listen := flags.String("http01-listen", http01.DefaultListen, "Address HOST:PORT of the http-01 server (optional)")
+	http01RedirectHTTPS := flags.Bool("http01-redirect-https", false, "Redirect the requests outside of the challenge paths to HTTPS (optional; default 404)")
+	var http01Upstream *url.URL
+	flags.Func("http01-upstream", "URL of the site receiving the requests outside of the challenge paths through the http-01 server (optional; default 404)", func(value string) error {
+		upstream, err := url.Parse(value)
+		if err != nil || (upstream.Scheme != "http" && upstream.Scheme != "https") || upstream.Host == "" {
+			return fmt.Errorf("invalid upstream URL %q", value)
+		}
+		http01Upstream = upstream
+		return nil
+	})
+	http01StrictHost := flags.Bool("http01-strict-host", false, "Only answer http-01 challenges to requests whose Host is the identifier of the challenge (optional; default false)")
+	dnsCapture := flags.String("dns-capture", "", "Append every DNS query and answer to this JSON-lines file, read by the dns-log command (optional)")
+
+	// Handle multiple --authz flags
+	var authzList []string
+	flags.Func("authz", "Authorization URL to deactivate (required by deauthorize, can be multiple)", func(authz string) error {
+		authzList = append(authzList, authz)
+		return nil
+	})
+
+	// Parse keyword argument flags (starting after the positional arguments)
+	err := flags.Parse(flagArgs)
 	if err != nil {
 		log.Fatalf("Error parsing flags: %v", err)
 	}
@@ -59,13 +270,147 @@ func main() {
 	if *dirURL == "" {
 		log.Fatal("--dir is required")
 	}
-	if *ipv4Address == "" {
+	if command == commandDeauthorize && len(authzList) == 0 {
+		log.Fatal("--authz is required (at least one authorization must be specified)")
+	}
+	if command != commandDeauthorize && *ipv4Address == "" {
 		log.Fatal("--record is required")
 	}
-	if len(domainList) == 0 {
+	if *ipv4Address != "" && (net.ParseIP(*ipv4Address) == nil || net.ParseIP(*ipv4Address).To4() == nil) {
+		log.Fatalf("--record must be an IPv4 address: %v", *ipv4Address)
+	}
+	if *ipv6Address != "" && (net.ParseIP(*ipv6Address) == nil || net.ParseIP(*ipv6Address).To4() != nil) {
+		log.Fatalf("--record6 must be an IPv6 address: %v", *ipv6Address)
+	}
+	if *acmeDNSListen != "" && *acmeDNSDomain == "" {
+		log.Fatal("--acmedns-domain is required by --acmedns-listen")
+	}
+	if http01Upstream != nil && *http01RedirectHTTPS {
+		log.Fatal("--http01-upstream and --http01-redirect-https cannot be used together")
+	}
+	if *csrFile != "" && *reuseKey {
+		log.Fatal("--csr and --reuse-key cannot be used together")
+	}
+	// The CSR is sent unchanged, the options building it would be silently ignored
+	if *csrFile != "" && (*subject != "" || *emptySubject || *mustStaple || len(extKeyUsage) > 0) {
+		log.Fatal("--csr cannot be used with --subject, --empty-subject, --must-staple or --eku")
+	}
+	if *subject != "" && *emptySubject {
+		log.Fatal("--subject and --empty-subject cannot be used together")
+	}
+
+	csrOpts := csrOptions{
+		EmptySubject: *emptySubject,
+		MustStaple:   *mustStaple,
+		ExtKeyUsage:  extKeyUsage,
+	}
+	if *subject != "" {
+		name, err := parseSubject(*subject)
+		if err != nil {
+			log.Fatalf("Invalid --subject: %v", err)
+		}
+		csrOpts.Subject = &name
+	}
+
+	// A supplied CSR defines the identifiers of the order, explicit domains must match them
+	var csr *x509.CertificateRequest
+	if *csrFile != "" {
+		csr, err = loadCSR(*csrFile)
+		if err != nil {
+			log.Fatalf("Failed to load CSR: %v", err)
+		}
+		if len(domainList) == 0 {
+			domainList = csrIdentifiers(csr)
+		} else if err := checkIdentifiers(csrIdentifiers(csr), domainList); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+
+	if command != commandDeauthorize && len(domainList) == 0 {
 		log.Fatal("--domain is required (at least one domain must be specified)")
 	}
 
+	certifCfg := httpCertif.Config{
+		DisableHTTP2:   *tlsDisableHTTP2,
+		HSTS:           *tlsHSTS,
+		HSTSSubdomains: *tlsHSTSSubdomains,
+	}
+	if *tlsMinVersion != "" {
+		if certifCfg.MinVersion, err = httpCertif.ParseTLSVersion(*tlsMinVersion); err != nil {
+			log.Fatalf("Invalid --tls-min-version: %v", err)
+		}
+	}
+	if *tlsCiphers != "" {
+		if certifCfg.CipherSuites, err = httpCertif.ParseCipherSuites(*tlsCiphers); err != nil {
+			log.Fatalf("Invalid --tls-ciphers: %v", err)
+		}
+	}
+	if *tlsCurves != "" {
+		if certifCfg.CurvePreferences, err = httpCertif.ParseCurves(*tlsCurves); err != nil {
+			log.Fatalf("Invalid --tls-curves: %v", err)
+		}
+	}
+	if *tlsClientCA != "" {
+		if certifCfg.ClientCAs, err = httpCertif.LoadCertPool(*tlsClientCA); err != nil {
+			log.Fatalf("Invalid --tls-client-ca: %v", err)
+		}
+	}
+
+	adminCfg := admin.Config{Listen: *adminListen, LegacyShutdown: *adminLegacyShutdown}
+	// Only issuing keeps the client running, under the control of the admin API
+	if command == commandIssue {
+		if *adminClientCA != "" {
+			if adminCfg.ClientCAs, err = httpCertif.LoadCertPool(*adminClientCA); err != nil {
+				log.Fatalf("Invalid --admin-client-ca: %v", err)
+			}
+			if *adminTLSCert == "" || *adminTLSKey == "" {
+				log.Fatal("--admin-client-ca requires --admin-tls-cert and --admin-tls-key")
+			}
+			adminCert, err := tls.LoadX509KeyPair(*adminTLSCert, *adminTLSKey)
+			if err != nil {
+				log.Fatalf("Failed to load the admin TLS certificate: %v", err)
+			}
+			adminCfg.Certificate = &adminCert
+		} else if adminCfg.Token, err = admin.LoadOrGenerateToken(*adminTokenFile); err != nil {
+			log.Fatalf("Failed to load the admin token: %v", err)
+		}
+	}
+
+	var dnssecSigners []*dns01.Signer
+	for _, zone := range dnssecZones {
+		algorithm, ok := dns01.Algorithms[strings.ToLower(*dnssecAlgorithm)]
+		if !ok {
+			log.Fatalf("Unsupported DNSSEC algorithm: %v", *dnssecAlgorithm)
+		}
+		signer, err := dns01.NewSigner(zone, algorithm, *dnssecKeys, *dnssecNSEC3)
+		if err != nil {
+			log.Fatalf("Failed to load DNSSEC keys of %v: %v", zone, err)
+		}
+		dnssecSigners = append(dnssecSigners, signer)
+	}
+
+	// Challenges answered by the built-in servers unless an external provider is configured
+	registry := solver.NewRegistry()
+	registry.Register(solver.TypeDNS01, dns01.Solver{})
+	registry.Register(solver.TypeHTTP01, http01.Solver{})
+	if webroots.Default != "" || len(webroots.PerDomain) > 0 {
+		registry.Register(solver.TypeHTTP01, webroots)
+	}
+	if *rfc2136Server != "" {
+		cfg := rfc2136.Config{Server: *rfc2136Server, Zone: *rfc2136Zone, Resolver: *rfc2136Resolver, PropagationTimeout: *rfc2136Timeout}
+		if *rfc2136TSIG != "" {
+			cfg.TSIGAlgorithm, cfg.TSIGName, cfg.TSIGSecret, err = rfc2136.ParseTSIG(*rfc2136TSIG)
+			if err != nil {
+				log.Fatalf("Invalid --rfc2136-tsig: %v", err)
+			}
+		}
+		provider, err := rfc2136.New(cfg)
+		if err != nil {
+			log.Fatalf("Failed to configure the RFC 2136 provider: %v", err)
+		}
+		registry.Register(solver.TypeDNS01, provider)
+	}
+
 	certFile := "./project/pebble.minica.pem"
 
 	// Read the certificate file
@@ -88,11 +433,32 @@ func main() {
 		"- Revoke: %v\n",
 		challengeType, *dirURL, *ipv4Address, domainList, *revoke)
 
-	messagesHTTP := make(chan string)
-	messagesDNS := make(chan string)
-	go http01.HTTP01(messagesHTTP)
-	go dns01.DNS01(messagesDNS, *ipv4Address)
-	go httpShutdown.HTTPShutdown()
+	// Deactivating authorizations does not need any challenge to be answered
+	if command != commandDeauthorize {
+		go http01.HTTP01(http01.Config{
+			Listen:        *http01Listen,
+			StrictHost:    *http01StrictHost,
+			Upstream:      http01Upstream,
+			RedirectHTTPS: *http01RedirectHTTPS,
+		})
+		dnsCfg := dns01.Config{
+			ARecord:     net.ParseIP(*ipv4Address),
+			AAAARecord:  net.ParseIP(*ipv6Address),
+			Addresses:   hostAddresses,
+			CAA:         caaList,
+			Delegations: delegations,
+			Signers:     dnssecSigners,
+			Zones:       zoneList,
+			Listeners:   dnsListeners,
+			Capture:     *dnsCapture,
+		}
+		// The solver reads the delegations from this goroutine, they are set before the server starts
+		dns01.Configure(dnsCfg)
+		go dns01.DNS01(dnsCfg)
+		if *acmeDNSListen != "" {
+			go dns01.ACMEDNS(dns01.ACMEDNSConfig{Listen: *acmeDNSListen, Domain: *acmeDNSDomain, Storage: *acmeDNSStorage})
+		}
+	}
 
 	err, dir := retrieveDir(*dirURL, certPool)
 	if err != nil {
@@ -106,7 +472,22 @@ func main() {
 		log.Fatalf("%v/%v has crashed!", network.AcmeClientName, network.AcmeClientVersion)
 	}
 
-	noncebis, kid, pKey, err := createAccount(dir.NewAccount, nonce, certPool)
+	// Authorizations belong to the account, a stored account key is needed to use them across runs
+	var pKey *ecdsa.PrivateKey
+	if *accountKeyFile != "" {
+		pKey, err = crypto.LoadOrGenerateKeys(*accountKeyFile)
+	} else {
+		if command != commandIssue {
+			logger.Logger().Warn().Msgf("No --account-key given, the authorizations will belong to a throwaway account")
+		}
+		pKey, err = crypto.GenerateNewKeys()
+	}
+	if err != nil {
+		logger.Logger().Error().Msgf("Error while loading account keys: %v", err)
+		log.Fatalf("%v/%v has crashed!", network.AcmeClientName, network.AcmeClientVersion)
+	}
+
+	noncebis, kid, err := createAccount(dir.NewAccount, nonce, certPool, pKey)
 	if err != nil {
 		logger.Logger().Error().Msgf("Error while createAccount: %v", err)
 		log.Fatalf("%v/%v has crashed!", network.AcmeClientName, network.AcmeClientVersion)
@@ -119,111 +500,92 @@ func main() {
 		log.Fatalf("%v/%v has crashed!", network.AcmeClientName, network.AcmeClientVersion)
 	}
 
-	order, orderLocation, err := createOrder(&netState, dir.NewOrder, domainList)
-	if err != nil {
-		logger.Logger().Error().Msgf("Error while createOrder: %v", err)
-		log.Fatalf("%v/%v has crashed!", network.AcmeClientName, network.AcmeClientVersion)
+	thum, _ := getThumbprint(pKey)
+
+	chalCfg := challengeConfig{
+		registry:    registry,
+		defaultType: solver.ChallengeType(challengeType),
+		perDomain:   perDomainChallenge,
+		thumbprint:  thum,
+	}
+	if *propagationCheck {
+		chalCfg.propagation = &propagation.Checker{
+			Resolver:    *propagationResolver,
+			Nameservers: propagationNameservers,
+			Timeout:     *propagationTimeout,
+		}
+		if len(propagationNameservers) == 0 && *propagationResolver == "" {
+			chalCfg.propagation.Resolver, err = systemResolver()
+			if err != nil {
+				log.Fatalf("--propagation-check needs a resolver: %v", err)
+			}
+		}
 	}
 
-	for _, auth := range order.Authorizations {
-		challenges, err := fetchChallenges(&netState, auth, false)
+	switch command {
+	case commandAuthorize:
+		authzURLs, err := preAuthorize(context.Background(), &netState, dir.NewAuthz, domainList, chalCfg)
 		if err != nil {
-			logger.Logger().Error().Msgf("Error while fetchingChallenges: %v", err)
+			logger.Logger().Error().Msgf("Error while preAuthorize: %v", err)
 			log.Fatalf("%v/%v has crashed!", network.AcmeClientName, network.AcmeClientVersion)
 		}
-
-		thum, _ := getThumbprint(pKey)
-
-		for _, chal := range challenges.Challenges {
-
-			// Provide requested Challenge
-			if chal.Type == "dns-01" && challengeType == "dns01" {
-				hash := sha256.Sum256([]byte(chal.Token + "." + thum))
-				keyAuth := base64.RawURLEncoding.EncodeToString(hash[:])
-
-				messagesDNS <- keyAuth
-			} else if chal.Type == "http-01" && challengeType == "http01" {
-				messagesHTTP <- chal.Token + "." + thum
-			} else {
-				// If no valid challenge, we do not poll, continue to next iteration
-				continue
-			}
-
-			// Poll mechanism
-			chalnew, err := fetchChallenges(&netState, chal.Url, true)
+		for i, authzURL := range authzURLs {
+			logger.Logger().Info().Msgf("Authorized %v: %v", domainList[i], authzURL)
+		}
+		return
+	case commandDeauthorize:
+		for _, authzURL := range authzList {
+			err = deactivateAuthorization(&netState, authzURL)
 			if err != nil {
-				logger.Logger().Error().Msgf("Error while pingingFetchedChallenge: %v", err)
+				logger.Logger().Error().Msgf("Error while deactivateAuthorization: %v", err)
 				log.Fatalf("%v/%v has crashed!", network.AcmeClientName, network.AcmeClientVersion)
 			}
-			time.Sleep(1 * time.Second)
-
-			for count := 0; count < 5; count++ {
-				logger.Logger().Debug().Msgf("\nATTEMPT: %v\n", count)
-
-				// Query to get status
-				chalnew, err = fetchChallenges(&netState, chal.Url, false)
-				if err != nil {
-					logger.Logger().Error().Msgf("Error while pingingFetchedChallenge: %v", err)
-					log.Fatalf("%v/%v has crashed!", network.AcmeClientName, network.AcmeClientVersion)
-				}
-
-				if chalnew.Status == "valid" { // processing
-					break
-				}
-				time.Sleep(5 * time.Second)
-			}
-
+			logger.Logger().Info().Msgf("Deactivated %v", authzURL)
 		}
-
-	}
-
-	certifKeysEnc, err := genCertif(&netState, order.Finalize, domainList)
-	if err != nil {
-		logger.Logger().Error().Msgf("Error while gen certif: %v", err)
-		log.Fatalf("%v/%v has crashed!", network.AcmeClientName, network.AcmeClientVersion)
+		return
 	}
 
-	orderReadyFlag := false
-	var myOrder Order
-
-	for !orderReadyFlag {
-		myOrder, err = getOrderStatus(&netState, orderLocation)
-		if err != nil {
-			logger.Logger().Error().Msgf("Error while get Order: %v", err)
-			log.Fatalf("%v/%v has crashed!", network.AcmeClientName, network.AcmeClientVersion)
+	// Warn before creating the order if the CA is going to refuse it
+	if *caaCheck {
+		resolver := *caaResolver
+		if resolver == "" {
+			resolver, err = systemResolver()
 		}
-
-		if myOrder.Status == "valid" {
-			orderReadyFlag = true
+		if err != nil {
+			logger.Logger().Warn().Msgf("Skipping CAA check, no resolver: %v", err)
+		} else if problems := checkCAA(resolver, domainList, dir.Meta.CaaIdentities, kid, chalCfg); problems > 0 {
+			logger.Logger().Warn().Msgf("CAA check found problems for %v identifiers", problems)
 		}
-		time.Sleep(100 * time.Millisecond)
 	}
 
-	certifBody, err := downloadCertificate(&netState, myOrder.Certificate)
-	if err != nil {
-		logger.Logger().Error().Msgf("Error while download certif: %v", err)
-		log.Fatalf("%v/%v has crashed!", network.AcmeClientName, network.AcmeClientVersion)
+	ctl := &controller{
+		netState:  &netState,
+		dir:       dir,
+		dirURL:    *dirURL,
+		account:   kid,
+		chalCfg:   chalCfg,
+		domains:   domainList,
+		csr:       csr,
+		csrOpts:   csrOpts,
+		reuseKey:  *reuseKey,
+		keyFile:   *keyFile,
+		certOut:   *certOut,
+		certifCfg: certifCfg,
+		started:   time.Now(),
 	}
+	httpCertif.Certificates.ConfigureOCSP(httpCertif.OCSPConfig{Enabled: *ocspStaple, Responder: *ocspResponder})
 
-	certificateKeysString, _ := network.X509keysStringForDebug(certifKeysEnc, &certifKeysEnc.PublicKey)
-
-	// DEBUG Code to generate *.pem files for certificate
-	//err = os.WriteFile("cert.pem", []byte(certifBody), 0644)
-	//if err != nil {
-	//	log.Fatalf("Failed to write certificate to file: %v", err)
-	//}
-	//
-	//err = os.WriteFile("key.pem", []byte(certificateKeysString), 0600)
-	//if err != nil {
-	//	log.Fatalf("Failed to write private key to file: %v", err)
-	//}
+	// The admin API is the control plane of the client until it is shut down
+	adminCfg.Controller = ctl
+	go admin.Admin(adminCfg)
 
-	go httpCertif.HTTPCertificate(certifBody, certificateKeysString)
+	if err := ctl.issue(context.Background()); err != nil {
+		logger.Logger().Error().Msgf("Error while issuing the certificate: %v", err)
+		log.Fatalf("%v/%v has crashed!", network.AcmeClientName, network.AcmeClientVersion)
+	}
 
 	if *revoke {
-		blk, _ := pem.Decode([]byte(certifBody))
-		err = revokeCert(&netState, dir.RevokeCert, base64.RawURLEncoding.EncodeToString(blk.Bytes))
-		if err != nil {
+		if err := ctl.Revoke(ctl.name()); err != nil {
 			log.Fatalf("Failed to revoke certificate: %v", err)
 		}
 	}
@@ -233,19 +595,28 @@ func main() {
 
 	for !shutdownFlag {
 		select {
-		case <-httpShutdown.ShutdownChannel: // Receive the sleep message
+		case <-admin.ShutdownChannel: // Receive the sleep message
 			slog.Info("Receive the sleepy message")
 			if err := http01.Server.Shutdown(context.Background()); err != nil {
 				slog.Error("Error while stopping the http01 server", "err", err)
 			}
-			if err := dns01.Server.Shutdown(); err != nil {
+			if err := dns01.Shutdown(); err != nil {
 				slog.Error("Error while stopping the dns01 server", "err", err)
 			}
-			if err := httpCertif.Server.Shutdown(context.Background()); err != nil {
+			if dns01.ACMEDNSServer != nil {
+				if err := dns01.ACMEDNSServer.Shutdown(context.Background()); err != nil {
+					slog.Error("Error while stopping the acme-dns server", "err", err)
+				}
+			}
+			http01.CleanUpAll()
+			dns01.CleanUpAll()
+			if err := httpCertif.Shutdown(context.Background()); err != nil {
 				slog.Error("Error while stopping the http certificate server", "err", err)
 			}
-			if err := httpShutdown.Server.Shutdown(context.Background()); err != nil {
-				slog.Error("Error while stopping the http shutdown server", "err", err)
+			if admin.Server != nil {
+				if err := admin.Server.Shutdown(context.Background()); err != nil {
+					slog.Error("Error while stopping the admin server", "err", err)
+				}
 			}
 			shutdownFlag = true
 		case <-time.After(100 * time.Millisecond): // When done is closed, exit the loop
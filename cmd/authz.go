@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/logger"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/network"
+	"io"
+	"net/http"
+	"strings"
+)
+
+type newAuthz struct {
+	Identifier identifiers `json:"identifier"`
+}
+
+type authzUpdate struct {
+	Status string `json:"status"`
+}
+
+// preAuthorize creates a new authorization for each domain through the newAuthz resource and validates it with the
+// configured challenge. It returns the authorization URLs in the order of domainList.
+func preAuthorize(ctx context.Context, netState *network.StateNetwork, url string, domainList []string, cfg challengeConfig) ([]string, error) {
+	if url == "" {
+		return nil, errors.New("the ACME server does not support pre-authorization (no newAuthz in directory)")
+	}
+
+	var authzURLs []string
+	var report authzReport
+	defer report.log()
+
+	for _, domain := range domainList {
+		// RFC 8555 section 7.4.1, wildcard identifiers cannot be pre-authorized
+		if strings.HasPrefix(domain, "*.") {
+			return nil, fmt.Errorf("wildcard identifier %v cannot be pre-authorized", domain)
+		}
+
+		payload := newAuthz{
+			Identifier: identifiers{
+				Type:  "dns",
+				Value: domain,
+			},
+		}
+
+		jsonPayload, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := network.SendPayloadThroughJWS(jsonPayload, url, netState)
+		if err != nil {
+			return nil, err
+		}
+
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		logger.Logger().Debug().Msgf("\nRES:" + string(body) + "\n")
+
+		if res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("newAuthz for %v failed with status %v", domain, res.Status)
+		}
+
+		authzURL := res.Header.Get("Location")
+		if authzURL == "" {
+			return nil, errors.New("no Location")
+		}
+
+		_, reused, err := solveAuthorization(ctx, netState, authzURL, cfg)
+		if err != nil {
+			return nil, err
+		}
+		report.add(domain, reused)
+
+		authzURLs = append(authzURLs, authzURL)
+	}
+
+	return authzURLs, nil
+}
+
+// deactivateAuthorization asks the ACME server to deactivate the authorization at url (RFC 8555 section 7.5.2).
+func deactivateAuthorization(netState *network.StateNetwork, url string) error {
+
+	jsonPayload, err := json.Marshal(authzUpdate{Status: "deactivated"})
+	if err != nil {
+		return err
+	}
+
+	res, err := network.SendPayloadThroughJWS(jsonPayload, url, netState)
+	if err != nil {
+		return err
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	logger.Logger().Debug().Msgf("\nRES:" + string(body) + "\n")
+
+	// Init the data structure
+	authz := challengesList{}
+
+	err = json.Unmarshal(body, &authz)
+	if err != nil {
+		return err
+	}
+
+	if authz.Status != "deactivated" {
+		return fmt.Errorf("authorization %v is %v instead of deactivated", url, authz.Status)
+	}
+
+	return nil
+}
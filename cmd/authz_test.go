@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPreAuthorize(t *testing.T) {
+	defer func(interval time.Duration) { pollInterval = interval }(pollInterval)
+	pollInterval = 10 * time.Millisecond
+
+	s := &recordingSolver{}
+	f := newFakeACME(t, "valid")
+	authzURLs, err := preAuthorize(context.Background(), f.netState(t), f.URL+"/new-authz", []string{"example.com"}, fakeChallengeConfig(s))
+	if err != nil || len(authzURLs) != 1 || authzURLs[0] != f.URL+"/authz/example.com" {
+		t.Fatalf("Valid authorization refused: %v %v", authzURLs, err)
+	}
+	if len(s.presented) != 0 {
+		t.Errorf("Challenges not cleaned up: %v", s.presented)
+	}
+
+	// A challenge the CA rejects fails the authorization with the problem it reported
+	f = newFakeACME(t, "invalid")
+	authzURLs, err = preAuthorize(context.Background(), f.netState(t), f.URL+"/new-authz", []string{"example.com"}, fakeChallengeConfig(s))
+	if err == nil || !strings.Contains(err.Error(), "is invalid") || !strings.Contains(err.Error(), "Invalid response from") {
+		t.Errorf("Invalid authorization accepted: %v %v", authzURLs, err)
+	}
+
+	// So does a challenge the CA never finishes
+	f = newFakeACME(t, "processing")
+	if _, err = preAuthorize(context.Background(), f.netState(t), f.URL+"/new-authz", []string{"example.com"}, fakeChallengeConfig(s)); err == nil || !strings.Contains(err.Error(), "not validated in time") {
+		t.Errorf("Unfinished authorization accepted: %v", err)
+	}
+	if len(s.presented) != 0 {
+		t.Errorf("Challenges not cleaned up: %v", s.presented)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/caa"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/logger"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// caaLookupTimeout bounds the CAA lookups of one identifier
+const caaLookupTimeout = 5 * time.Second
+
+// systemResolver returns the first name server of /etc/resolv.conf.
+func systemResolver() (string, error) {
+	conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return "", err
+	}
+	if len(conf.Servers) == 0 {
+		return "", errors.New("no name server in /etc/resolv.conf")
+	}
+	return net.JoinHostPort(conf.Servers[0], conf.Port), nil
+}
+
+// checkCAA resolves the CAA records of every identifier through resolver and warns about the identifiers the CA
+// would refuse to issue for. It returns the number of such identifiers.
+func checkCAA(resolver string, domainList []string, caaIdentities []string, kid string, cfg challengeConfig) int {
+	problems := 0
+
+	for _, domain := range domainList {
+		ctx, cancel := context.WithTimeout(context.Background(), caaLookupTimeout)
+		records, owner, err := caa.Lookup(ctx, resolver, domain)
+		cancel()
+		if err != nil {
+			logger.Logger().Warn().Msgf("CAA lookup for %v failed, the CA will refuse to issue if it fails too: %v", domain, err)
+			problems++
+			continue
+		}
+
+		err = caa.Check(records, caa.Request{
+			Identifier:       domain,
+			CAAIdentities:    caaIdentities,
+			AccountURI:       kid,
+			ValidationMethod: cfg.typeFor(domain),
+		})
+		if err != nil {
+			logger.Logger().Warn().Msgf("CAA records at %v forbid issuance for %v: %v", owner, domain, err)
+			problems++
+			continue
+		}
+
+		logger.Logger().Debug().Msgf("CAA allows issuance for %v", domain)
+	}
+
+	return problems
+}
+
+// parseCAAFlag parses a --caa value written as NAME=TAG:VALUE, e.g. example.com=issue:ca.example; validationmethods=dns-01
+func parseCAAFlag(value string) (*dns.CAA, error) {
+	name, property, found := strings.Cut(value, "=")
+	tag, propertyValue, foundTag := strings.Cut(property, ":")
+	if !found || !foundTag || name == "" {
+		return nil, errors.New("invalid CAA record " + value + ", expected NAME=TAG:VALUE")
+	}
+	return caa.NewRecord(name, 0, tag, propertyValue)
+}
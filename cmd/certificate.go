@@ -5,56 +5,244 @@ import (
 	"crypto/rand"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/base64"
 	"encoding/json"
-	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/crypto"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/httpCertif"
 	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/logger"
 	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/network"
 	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
 )
 
 type postCsr struct {
 	Csr string `json:"csr"`
 }
 
-func genCertif(netState *network.StateNetwork, url string, domain []string) (*ecdsa.PrivateKey, error) {
+// oidExtensionExtKeyUsage is the X.509 extended key usage extension
+var oidExtensionExtKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37}
 
-	certifKeys, err := crypto.GenerateNewKeys()
-	if err != nil {
-		return nil, err
+// extKeyUsages maps the names accepted by --eku to their OID
+var extKeyUsages = map[string]asn1.ObjectIdentifier{
+	"serverAuth":      {1, 3, 6, 1, 5, 5, 7, 3, 1},
+	"clientAuth":      {1, 3, 6, 1, 5, 5, 7, 3, 2},
+	"codeSigning":     {1, 3, 6, 1, 5, 5, 7, 3, 3},
+	"emailProtection": {1, 3, 6, 1, 5, 5, 7, 3, 4},
+	"timeStamping":    {1, 3, 6, 1, 5, 5, 7, 3, 8},
+	"OCSPSigning":     {1, 3, 6, 1, 5, 5, 7, 3, 9},
+}
+
+// csrOptions customizes the CSR built by newCSR.
+type csrOptions struct {
+	// Subject replaces the default subject (CN=first domain, C=CH) when set
+	Subject *pkix.Name
+	// EmptySubject leaves the subject empty, identifiers are only carried by the SANs
+	EmptySubject bool
+	// MustStaple adds the TLS Feature extension requesting status_request
+	MustStaple bool
+	// ExtKeyUsage lists the names of the extended key usages to request
+	ExtKeyUsage []string
+}
+
+// parseSubject parses a subject given as comma separated attributes, e.g. "C=CH,O=ETH Zurich,CN=example.com".
+// A comma inside a value can be escaped with a backslash.
+func parseSubject(subject string) (pkix.Name, error) {
+	var name pkix.Name
+
+	var attrs []string
+	var current strings.Builder
+	for i := 0; i < len(subject); i++ {
+		if subject[i] == '\\' && i+1 < len(subject) {
+			i++
+			current.WriteByte(subject[i])
+			continue
+		}
+		if subject[i] == ',' {
+			attrs = append(attrs, current.String())
+			current.Reset()
+			continue
+		}
+		current.WriteByte(subject[i])
+	}
+	attrs = append(attrs, current.String())
+
+	for _, attr := range attrs {
+		key, value, found := strings.Cut(attr, "=")
+		key = strings.ToUpper(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if !found || key == "" || value == "" {
+			return pkix.Name{}, fmt.Errorf("invalid subject attribute %q", attr)
+		}
+
+		switch key {
+		case "CN":
+			name.CommonName = value
+		case "C":
+			name.Country = append(name.Country, value)
+		case "O":
+			name.Organization = append(name.Organization, value)
+		case "OU":
+			name.OrganizationalUnit = append(name.OrganizationalUnit, value)
+		case "L":
+			name.Locality = append(name.Locality, value)
+		case "ST":
+			name.Province = append(name.Province, value)
+		case "STREET":
+			name.StreetAddress = append(name.StreetAddress, value)
+		case "POSTALCODE":
+			name.PostalCode = append(name.PostalCode, value)
+		case "SERIALNUMBER":
+			name.SerialNumber = value
+		default:
+			return pkix.Name{}, fmt.Errorf("unsupported subject attribute %q", key)
+		}
+	}
+
+	return name, nil
+}
+
+// newCSR builds a DER encoded certificate signing request for the domains, signed with certifKeys.
+func newCSR(domain []string, certifKeys *ecdsa.PrivateKey, opts csrOptions) ([]byte, error) {
+	subject := pkix.Name{
+		CommonName: domain[0],
+		Country:    []string{"CH"},
+	}
+	if opts.EmptySubject {
+		subject = pkix.Name{}
+	} else if opts.Subject != nil {
+		subject = *opts.Subject
+	}
+
+	// The CA would reject a common name that is not one of the identifiers
+	if subject.CommonName != "" && !slices.Contains(domain, subject.CommonName) {
+		return nil, fmt.Errorf("subject common name %q is not one of the domains %v", subject.CommonName, domain)
+	}
+
+	var extensions []pkix.Extension
+
+	if opts.MustStaple {
+		value, err := asn1.Marshal([]int{httpCertif.TLSFeatureStatusRequest})
+		if err != nil {
+			return nil, err
+		}
+		extensions = append(extensions, pkix.Extension{Id: httpCertif.OIDExtensionTLSFeature, Value: value})
 	}
 
-	certReq, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+	if len(opts.ExtKeyUsage) > 0 {
+		var oids []asn1.ObjectIdentifier
+		for _, usage := range opts.ExtKeyUsage {
+			oid, ok := extKeyUsages[usage]
+			if !ok {
+				return nil, fmt.Errorf("unknown extended key usage %q", usage)
+			}
+			oids = append(oids, oid)
+		}
+		value, err := asn1.Marshal(oids)
+		if err != nil {
+			return nil, err
+		}
+		extensions = append(extensions, pkix.Extension{Id: oidExtensionExtKeyUsage, Value: value})
+	}
+
+	return x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
 		SignatureAlgorithm: x509.ECDSAWithSHA256,
-		Subject: pkix.Name{
-			CommonName: domain[0],
-			Country:    []string{"CH"},
-		},
-		DNSNames: domain,
+		Subject:            subject,
+		DNSNames:           domain,
+		ExtraExtensions:    extensions,
 	}, certifKeys)
+}
+
+// loadCSR reads a PEM encoded certificate signing request from path and checks its signature.
+func loadCSR(path string) (*x509.CertificateRequest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	blk, _ := pem.Decode(data)
+	if blk == nil || (blk.Type != "CERTIFICATE REQUEST" && blk.Type != "NEW CERTIFICATE REQUEST") {
+		return nil, errors.New("no CERTIFICATE REQUEST PEM block found in " + path)
+	}
+
+	csr, err := x509.ParseCertificateRequest(blk.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid CSR signature: %w", err)
+	}
+
+	return csr, nil
+}
+
+// csrIdentifiers returns the DNS identifiers requested by the CSR: its SANs, plus the common name if it is not one of them.
+func csrIdentifiers(csr *x509.CertificateRequest) []string {
+	domains := slices.Clone(csr.DNSNames)
+
+	cn := csr.Subject.CommonName
+	if cn != "" && !slices.ContainsFunc(domains, func(d string) bool { return strings.EqualFold(d, cn) }) {
+		domains = append(domains, cn)
+	}
+
+	return domains
+}
 
-	csr := base64.RawURLEncoding.EncodeToString(certReq)
+// checkIdentifiers ensures that the CSR requests exactly the identifiers of the order.
+func checkIdentifiers(csrDomains []string, orderDomains []string) error {
+	normalize := func(domains []string) []string {
+		out := make([]string, 0, len(domains))
+		for _, d := range domains {
+			out = append(out, strings.ToLower(strings.TrimSuffix(d, ".")))
+		}
+		slices.Sort(out)
+		return slices.Compact(out)
+	}
 
-	csrStruct := postCsr{csr}
+	if !slices.Equal(normalize(csrDomains), normalize(orderDomains)) {
+		return fmt.Errorf("CSR identifiers %v do not match the order identifiers %v", csrDomains, orderDomains)
+	}
+
+	return nil
+}
+
+// genCertif finalizes the order at url with the DER encoded csr.
+func genCertif(netState *network.StateNetwork, url string, csr []byte) error {
+
+	csrStruct := postCsr{base64.RawURLEncoding.EncodeToString(csr)}
 
 	jsonPayload, err := json.Marshal(csrStruct)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	res, err := network.SendPayloadThroughJWS(jsonPayload, url, netState)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	logger.Logger().Debug().Msgf("\nRES:" + string(body) + "\n")
 
-	return certifKeys, nil
+	// The CA explains with a problem document why it rejects the CSR (badCSR, rejectedIdentifier...)
+	if res.StatusCode != http.StatusOK {
+		var problem acmeProblem
+		if err := json.Unmarshal(body, &problem); err != nil || problem.Type == "" {
+			return fmt.Errorf("finalize refused: %v", res.Status)
+		}
+		return fmt.Errorf("finalize refused: %v", &problem)
+	}
+	return nil
 }
 
 func downloadCertificate(netState *network.StateNetwork, url string) (string, error) {
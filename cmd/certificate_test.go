@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/crypto"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/httpCertif"
+)
+
+func TestParseSubject(t *testing.T) {
+	name, err := parseSubject(`C=CH, O=Foo\, Bar,CN=example.com`)
+	if err != nil {
+		t.Fatalf("parseSubject failed: %v", err)
+	}
+	if name.CommonName != "example.com" || name.Country[0] != "CH" || name.Organization[0] != "Foo, Bar" {
+		t.Errorf("Wrong subject: %v", name)
+	}
+
+	if _, err := parseSubject("X=1"); err == nil {
+		t.Errorf("Unsupported attribute accepted")
+	}
+}
+
+func TestNewCSRExtensions(t *testing.T) {
+	pKey, _ := crypto.GenerateNewKeys()
+	der, err := newCSR([]string{"example.com", "www.example.com"}, pKey, csrOptions{
+		EmptySubject: true,
+		MustStaple:   true,
+		ExtKeyUsage:  []string{"serverAuth", "clientAuth"},
+	})
+	if err != nil {
+		t.Fatalf("newCSR failed: %v", err)
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatalf("Could not parse CSR: %v", err)
+	}
+	if len(csr.Subject.Names) != 0 {
+		t.Errorf("Subject is not empty: %v", csr.Subject)
+	}
+
+	found := map[string]bool{}
+	for _, ext := range csr.Extensions {
+		found[ext.Id.String()] = true
+	}
+	if !found[httpCertif.OIDExtensionTLSFeature.String()] || !found[oidExtensionExtKeyUsage.String()] {
+		t.Errorf("Missing extensions: %v", found)
+	}
+
+	if err := checkIdentifiers(csrIdentifiers(csr), []string{"www.example.com", "EXAMPLE.com."}); err != nil {
+		t.Errorf("Identifiers should match: %v", err)
+	}
+}
+
+// writeCSR stores a PEM encoded CSR of domains, with common name cn, in a temporary file.
+func writeCSR(t *testing.T, cn string, domains []string) string {
+	pKey, _ := crypto.GenerateNewKeys()
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: cn},
+		DNSNames: domains,
+	}, pKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "request.csr")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadCSR(t *testing.T) {
+	csr, err := loadCSR(writeCSR(t, "example.org", []string{"example.com", "www.example.com"}))
+	if err != nil {
+		t.Fatalf("loadCSR failed: %v", err)
+	}
+
+	// The common name is an identifier of the order when it is not a SAN
+	identifiers := csrIdentifiers(csr)
+	if !slices.Equal(identifiers, []string{"example.com", "www.example.com", "example.org"}) {
+		t.Errorf("Wrong identifiers: %v", identifiers)
+	}
+
+	for _, order := range [][]string{
+		{"example.com", "www.example.com"},
+		{"example.com", "www.example.com", "example.org", "other.org"},
+		{"example.com", "www.example.com", "*.example.org"},
+	} {
+		if err := checkIdentifiers(identifiers, order); err == nil {
+			t.Errorf("Identifiers %v should not match the order %v", identifiers, order)
+		}
+	}
+	if err := checkIdentifiers(identifiers, []string{"Example.org", "www.example.com.", "example.com", "example.com"}); err != nil {
+		t.Errorf("Identifiers should match: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "cert.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{1}}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCSR(path); err == nil {
+		t.Errorf("Certificate accepted as CSR")
+	}
+}
@@ -1,18 +1,34 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/logger"
 	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/network"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/propagation"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/solver"
 	"io"
+	"slices"
 	"time"
 )
 
 type challenge struct {
+	Type   string       `json:"type"`
+	Url    string       `json:"url"`
+	Token  string       `json:"token"`
+	Status string       `json:"status"`
+	Error  *acmeProblem `json:"error"`
+}
+
+// acmeProblem is the problem document (RFC 7807) explaining why the ACME server rejected a challenge
+type acmeProblem struct {
 	Type   string `json:"type"`
-	Url    string `json:"url"`
-	Token  string `json:"token"`
-	Status string `json:"status"`
+	Detail string `json:"detail"`
+}
+
+func (problem *acmeProblem) String() string {
+	return fmt.Sprintf("%v (%v)", problem.Detail, problem.Type)
 }
 
 type challengesList struct {
@@ -23,6 +39,33 @@ type challengesList struct {
 	} `json:"identifier"`
 	Challenges []challenge `json:"challenges"`
 	Expires    time.Time   `json:"expires"`
+	Wildcard   bool        `json:"wildcard"`
+}
+
+// name returns the identifier of the authorization as it was written in the order, e.g. *.example.com
+func (authz challengesList) name() string {
+	if authz.Wildcard {
+		return "*." + authz.Identifier.Value
+	}
+	return authz.Identifier.Value
+}
+
+// authzReport records which identifiers were validated during this run and which reused an existing authorization
+type authzReport struct {
+	Validated []string
+	Reused    []string
+}
+
+func (report *authzReport) add(identifier string, reused bool) {
+	if reused {
+		report.Reused = append(report.Reused, identifier)
+	} else {
+		report.Validated = append(report.Validated, identifier)
+	}
+}
+
+func (report *authzReport) log() {
+	logger.Logger().Info().Msgf("Authorizations validated: %v, reused: %v", report.Validated, report.Reused)
 }
 
 func fetchChallenges(netState *network.StateNetwork, url string, includeCurlyBracesPayload bool) (challengesList, error) {
@@ -55,3 +98,135 @@ func fetchChallenges(netState *network.StateNetwork, url string, includeCurlyBra
 
 	return challengeList, nil
 }
+
+// pollInterval between two queries of the status of a challenge, variable so that tests do not wait
+var pollInterval = 5 * time.Second
+
+// challengeConfig selects the challenge type of each identifier and the Solver answering it
+type challengeConfig struct {
+	// registry maps the ACME challenge types to their Solver
+	registry *solver.Registry
+	// defaultType is the ACME challenge type of identifiers without a perDomain entry
+	defaultType string
+	// perDomain maps an identifier, as written in the order (e.g. *.example.com), to its ACME challenge type
+	perDomain map[string]string
+	// thumbprint of the account key, used to compute the key authorizations
+	thumbprint string
+	// propagation, when set, checks that the dns-01 TXT records are served before triggering validation
+	propagation *propagation.Checker
+}
+
+// typeFor returns the ACME challenge type to use for identifier.
+func (cfg challengeConfig) typeFor(identifier string) string {
+	if challengeType, ok := cfg.perDomain[identifier]; ok {
+		return challengeType
+	}
+	return cfg.defaultType
+}
+
+// solveAuthorization answers the configured challenge of the authorization at authURL and polls it until the ACME
+// server validated it. Authorizations that are already valid are reused without answering any challenge, and
+// challenges already being processed are only polled. It returns the identifier of the authorization and whether it
+// was reused.
+func solveAuthorization(ctx context.Context, netState *network.StateNetwork, authURL string, cfg challengeConfig) (string, bool, error) {
+	challenges, err := fetchChallenges(netState, authURL, false)
+	if err != nil {
+		return "", false, err
+	}
+
+	switch challenges.Status {
+	case "valid":
+		logger.Logger().Info().Msgf("Reusing valid authorization for %v", challenges.name())
+		return challenges.name(), true, nil
+	case "pending":
+	default:
+		return "", false, fmt.Errorf("authorization for %v is %v", challenges.name(), challenges.Status)
+	}
+
+	challengeType := cfg.typeFor(challenges.name())
+	chalSolver, ok := cfg.registry.Get(challengeType)
+	if !ok {
+		return "", false, fmt.Errorf("no solver registered for %v challenges", challengeType)
+	}
+
+	idx := slices.IndexFunc(challenges.Challenges, func(chal challenge) bool { return chal.Type == challengeType })
+	if idx < 0 {
+		return "", false, fmt.Errorf("authorization for %v does not offer a %v challenge", challenges.name(), challengeType)
+	}
+	chal := challenges.Challenges[idx]
+
+	// The published response is only useful until the authorization expires
+	if !challenges.Expires.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, challenges.Expires)
+		defer cancel()
+	}
+
+	// Provide requested Challenge, and remove it once the authorization is finished whatever its outcome
+	keyAuth := chal.Token + "." + cfg.thumbprint
+	err = chalSolver.Present(ctx, challenges.name(), chal.Token, keyAuth)
+	if err != nil {
+		return "", false, fmt.Errorf("could not present %v challenge for %v: %w", challengeType, challenges.name(), err)
+	}
+	defer func() {
+		if err := chalSolver.CleanUp(context.Background(), challenges.name(), chal.Token, keyAuth); err != nil {
+			logger.Logger().Error().Msgf("Could not clean up %v challenge for %v: %v", challengeType, challenges.name(), err)
+		}
+	}()
+
+	// The ACME server may query any authoritative name server, all of them must serve the record
+	if challengeType == solver.TypeDNS01 && cfg.propagation != nil {
+		err = cfg.propagation.Wait(ctx, solver.DNS01Name(challenges.name()), solver.DNS01Value(keyAuth))
+		if err != nil {
+			return "", false, fmt.Errorf("dns-01 record for %v did not propagate: %w", challenges.name(), err)
+		}
+	}
+
+	// A challenge already being processed only needs to be polled, posting it again is useless
+	if chal.Status == "processing" {
+		logger.Logger().Info().Msgf("Challenge %v for %v is already processing", chal.Type, challenges.name())
+	} else {
+		_, err := fetchChallenges(netState, chal.Url, true)
+		if err != nil {
+			return "", false, err
+		}
+	}
+	time.Sleep(pollInterval / 5)
+
+	// Poll mechanism
+	for count := 0; count < 5; count++ {
+		logger.Logger().Debug().Msgf("\nATTEMPT: %v\n", count)
+
+		if ctx.Err() != nil {
+			return "", false, fmt.Errorf("authorization for %v expired while polling", challenges.name())
+		}
+
+		// Query to get status
+		chalnew, err := fetchChallenges(netState, chal.Url, false)
+		if err != nil {
+			return "", false, err
+		}
+
+		if chalnew.Status == "valid" || chalnew.Status == "invalid" {
+			break
+		}
+		time.Sleep(pollInterval)
+	}
+
+	// The authorization, not the challenge, tells whether the identifier may be issued for
+	authz, err := fetchChallenges(netState, authURL, false)
+	if err != nil {
+		return "", false, err
+	}
+	if authz.Status != "valid" {
+		detail := "not validated in time"
+		for _, c := range authz.Challenges {
+			if c.Url == chal.Url && c.Error != nil {
+				detail = c.Error.String()
+			}
+		}
+		return "", false, fmt.Errorf("authorization for %v is %v: %v", challenges.name(), authz.Status, detail)
+	}
+
+	return challenges.name(), false, nil
+}
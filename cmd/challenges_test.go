@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/solver"
+)
+
+func TestSolveAuthorizationStates(t *testing.T) {
+	defer func(interval time.Duration) { pollInterval = interval }(pollInterval)
+	pollInterval = 10 * time.Millisecond
+
+	f := newFakeACME(t, "valid")
+	f.initial["valid.example.com"] = "valid"
+	f.initial["processing.example.com"] = "processing"
+	netState := f.netState(t)
+
+	// A valid authorization is reused without answering its challenge
+	s := &recordingSolver{}
+	identifier, reused, err := solveAuthorization(context.Background(), netState, f.URL+"/authz/valid.example.com", fakeChallengeConfig(s))
+	if err != nil || identifier != "valid.example.com" || !reused {
+		t.Errorf("Valid authorization not reused: %v %v %v", identifier, reused, err)
+	}
+	if s.presented != nil || f.postCount("valid.example.com") != 0 {
+		t.Errorf("Valid authorization answered: %v", s.presented)
+	}
+
+	// A challenge already processing is polled, not posted again
+	identifier, reused, err = solveAuthorization(context.Background(), netState, f.URL+"/authz/processing.example.com", fakeChallengeConfig(s))
+	if err != nil || identifier != "processing.example.com" || reused {
+		t.Errorf("Processing authorization not solved: %v %v %v", identifier, reused, err)
+	}
+	if n := f.postCount("processing.example.com"); n != 0 {
+		t.Errorf("Processing challenge posted %v times", n)
+	}
+
+	// A pending challenge is posted once
+	if _, _, err = solveAuthorization(context.Background(), netState, f.URL+"/authz/example.com", fakeChallengeConfig(s)); err != nil {
+		t.Errorf("Pending authorization not solved: %v", err)
+	}
+	if n := f.postCount("example.com"); n != 1 {
+		t.Errorf("Pending challenge posted %v times", n)
+	}
+}
+
+func TestTypeFor(t *testing.T) {
+	cfg := challengeConfig{
+		defaultType: solver.TypeHTTP01,
+		perDomain:   map[string]string{"example.com": solver.TypeDNS01, "*.example.org": solver.TypeDNS01},
+	}
+	for _, test := range []struct {
+		identifier string
+		want       string
+	}{
+		{"example.com", solver.TypeDNS01},
+		{"*.example.org", solver.TypeDNS01},
+		{"example.org", solver.TypeHTTP01},
+		{"www.example.org", solver.TypeHTTP01},
+		{"*.example.com", solver.TypeHTTP01},
+		{"other.net", solver.TypeHTTP01},
+	} {
+		if got := cfg.typeFor(test.identifier); got != test.want {
+			t.Errorf("typeFor(%v) = %v, want %v", test.identifier, got, test.want)
+		}
+	}
+}
+
+func TestSolveAuthorizationType(t *testing.T) {
+	f := newFakeACME(t, "valid")
+	netState := f.netState(t)
+
+	// The identifier asks for dns-01, which has no solver
+	s := &recordingSolver{}
+	cfg := fakeChallengeConfig(s)
+	cfg.perDomain = map[string]string{"example.com": solver.TypeDNS01}
+	if _, _, err := solveAuthorization(context.Background(), netState, f.URL+"/authz/example.com", cfg); err == nil || !strings.Contains(err.Error(), "no solver registered for dns-01") {
+		t.Errorf("Missing solver accepted: %v", err)
+	}
+
+	// The solver exists but the authorization only offers http-01
+	cfg.registry.Register(solver.TypeDNS01, s)
+	if _, _, err := solveAuthorization(context.Background(), netState, f.URL+"/authz/example.com", cfg); err == nil || !strings.Contains(err.Error(), "does not offer a dns-01 challenge") {
+		t.Errorf("Missing challenge accepted: %v", err)
+	}
+	if s.presented != nil || f.postCount("example.com") != 0 {
+		t.Errorf("Challenge answered: %v", s.presented)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/admin"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/crypto"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/httpCertif"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/logger"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/network"
+	"os"
+	"sync"
+	"time"
+)
+
+// issuanceTimeout bounds the wait for the certificate of a finalized order
+const issuanceTimeout = 2 * time.Minute
+
+// controller issues the certificate of the domains and carries out the requests of the admin API on it.
+type controller struct {
+	// acme serializes the ACME requests, which share the nonce of netState
+	acme     sync.Mutex
+	netState *network.StateNetwork
+	dir      dir
+	dirURL   string
+	account  string
+	chalCfg  challengeConfig
+
+	// domains are the identifiers of the certificate, managed under the name of the first one
+	domains []string
+	// csr finalizes the orders unchanged when set, otherwise a CSR is built with csrOpts
+	csr      *x509.CertificateRequest
+	csrOpts  csrOptions
+	reuseKey bool
+	keyFile  string
+	certOut  string
+	// certifCfg configures the certificate server, started with the first certificate it can serve
+	certifCfg httpCertif.Config
+	serveOnce sync.Once
+	// serving serializes the updates of the served certificate, made without holding acme as they fetch OCSP staples
+	serving sync.Mutex
+
+	// mu protects the state below, started excepted
+	mu      sync.Mutex
+	started time.Time
+	// certPEM is the last certificate issued, issued when and revoked whether it was revoked since
+	certPEM string
+	issued  time.Time
+	revoked bool
+	lastErr string
+}
+
+// name returns the name the certificate is managed under.
+func (c *controller) name() string {
+	return c.domains[0]
+}
+
+// issue orders the certificate, serves it and writes it to certOut.
+func (c *controller) issue(ctx context.Context) error {
+	c.acme.Lock()
+	certifBody, certifKeysEnc, err := c.order(ctx)
+	c.mu.Lock()
+	if err != nil {
+		c.lastErr = err.Error()
+	} else {
+		c.certPEM, c.issued, c.revoked, c.lastErr = certifBody, time.Now(), false, ""
+	}
+	c.mu.Unlock()
+	c.acme.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if c.certOut != "" {
+		if err := os.WriteFile(c.certOut, []byte(certifBody), 0644); err != nil {
+			return fmt.Errorf("failed to write certificate to file: %w", err)
+		}
+	}
+
+	// Without the private key (externally generated CSR) the certificate cannot be served
+	if certifKeysEnc == nil {
+		logger.Logger().Info().Msgf("Certificate obtained from an external CSR, the certificate server is not started")
+		return nil
+	}
+	certificateKeysString, _ := network.X509keysStringForDebug(certifKeysEnc, &certifKeysEnc.PublicKey)
+	if err := c.serve(certifBody, certificateKeysString); err != nil {
+		logger.Logger().Error().Msgf("Certificate not served: %v", err)
+		return nil
+	}
+	c.serveOnce.Do(func() {
+		go httpCertif.HTTPCertificate(c.certifCfg)
+	})
+	return nil
+}
+
+// serve puts the certificate certPEM in the certificate server unless a newer one was issued meanwhile, and flags it
+// if it was revoked meanwhile.
+func (c *controller) serve(certPEM string, keyPEM string) error {
+	c.serving.Lock()
+	defer c.serving.Unlock()
+	c.mu.Lock()
+	latest := c.certPEM == certPEM
+	c.mu.Unlock()
+	if !latest {
+		return errors.New("superseded by a newer certificate")
+	}
+
+	if err := httpCertif.Certificates.PutPEM(c.name(), certPEM, keyPEM); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	revoked := c.revoked
+	c.mu.Unlock()
+	if revoked {
+		httpCertif.Certificates.MarkRevoked(c.name())
+	}
+	return nil
+}
+
+// order runs one order of the domains up to the download of the certificate. It returns the PEM chain and the
+// private key of the certificate, nil when finalized with the supplied CSR.
+func (c *controller) order(ctx context.Context) (string, *ecdsa.PrivateKey, error) {
+	order, orderLocation, err := createOrder(c.netState, c.dir.NewOrder, c.domains)
+	if err != nil {
+		logger.Logger().Error().Msgf("Error while createOrder: %v", err)
+		return "", nil, err
+	}
+
+	var report authzReport
+	for _, auth := range order.Authorizations {
+		identifier, reused, err := solveAuthorization(ctx, c.netState, auth, c.chalCfg)
+		if err != nil {
+			logger.Logger().Error().Msgf("Error while solveAuthorization: %v", err)
+			return "", nil, err
+		}
+		report.add(identifier, reused)
+	}
+	report.log()
+
+	// Finalize either with the supplied CSR or with a CSR built from a fresh (or reused) key
+	var certifKeysEnc *ecdsa.PrivateKey
+	var csrDER []byte
+	if c.csr != nil {
+		csrDER = c.csr.Raw
+	} else {
+		if c.reuseKey {
+			certifKeysEnc, err = crypto.LoadOrGenerateKeys(c.keyFile)
+		} else {
+			certifKeysEnc, err = crypto.GenerateNewKeys()
+		}
+		if err != nil {
+			logger.Logger().Error().Msgf("Error while loading certificate keys: %v", err)
+			return "", nil, err
+		}
+
+		csrDER, err = newCSR(c.domains, certifKeysEnc, c.csrOpts)
+		if err != nil {
+			logger.Logger().Error().Msgf("Error while creating CSR: %v", err)
+			return "", nil, err
+		}
+	}
+
+	err = genCertif(c.netState, order.Finalize, csrDER)
+	if err != nil {
+		logger.Logger().Error().Msgf("Error while gen certif: %v", err)
+		return "", nil, err
+	}
+
+	// The order is processing until the certificate is issued, bounded by its expiry and by issuanceTimeout
+	deadline := time.Now().Add(issuanceTimeout)
+	if !order.Expires.IsZero() && order.Expires.Before(deadline) {
+		deadline = order.Expires
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	orderReadyFlag := false
+	var myOrder Order
+
+	for !orderReadyFlag {
+		myOrder, err = getOrderStatus(c.netState, orderLocation)
+		if err != nil {
+			logger.Logger().Error().Msgf("Error while get Order: %v", err)
+			return "", nil, err
+		}
+
+		switch myOrder.Status {
+		case "valid":
+			orderReadyFlag = true
+			continue
+		case "invalid":
+			if myOrder.Error != nil {
+				return "", nil, fmt.Errorf("order is invalid: %v", myOrder.Error)
+			}
+			return "", nil, errors.New("order is invalid")
+		case "ready":
+			// A finalized order is processing or done, ready means the CA did not take the CSR
+			return "", nil, errors.New("order is still ready after finalize")
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", nil, fmt.Errorf("order is still %v: %w", myOrder.Status, ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	certifBody, err := downloadCertificate(c.netState, myOrder.Certificate)
+	if err != nil {
+		logger.Logger().Error().Msgf("Error while download certif: %v", err)
+		return "", nil, err
+	}
+	return certifBody, certifKeysEnc, nil
+}
+
+// Renew orders the certificate of name again, the renewed certificate replaces the served one.
+func (c *controller) Renew(name string) error {
+	if name != c.name() {
+		return admin.ErrUnknownName
+	}
+	return c.issue(context.Background())
+}
+
+// Revoke revokes the last certificate issued for name and flags it as revoked in the certificate server.
+func (c *controller) Revoke(name string) error {
+	if name != c.name() {
+		return admin.ErrUnknownName
+	}
+
+	if err := c.revoke(); err != nil {
+		return err
+	}
+	// The revoked certificate is still served until renewed, flagged in the certificate status
+	c.serving.Lock()
+	httpCertif.Certificates.MarkRevoked(name)
+	c.serving.Unlock()
+	logger.Logger().Info().Msgf("Revoked the certificate of %v", name)
+	return nil
+}
+
+// revoke revokes the last certificate issued.
+func (c *controller) revoke() error {
+	c.acme.Lock()
+	defer c.acme.Unlock()
+	c.mu.Lock()
+	certPEM, revoked := c.certPEM, c.revoked
+	c.mu.Unlock()
+	if certPEM == "" {
+		return errors.New("no certificate issued yet")
+	}
+	if revoked {
+		return errors.New("certificate already revoked")
+	}
+
+	blk, _ := pem.Decode([]byte(certPEM))
+	if blk == nil {
+		return errors.New("invalid certificate PEM")
+	}
+	if err := revokeCert(c.netState, c.dir.RevokeCert, base64.RawURLEncoding.EncodeToString(blk.Bytes)); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.revoked = true
+	c.mu.Unlock()
+	return nil
+}
+
+// certificateState describes a certificate managed by the controller.
+type certificateState struct {
+	Name    string     `json:"name"`
+	Domains []string   `json:"domains"`
+	Issued  *time.Time `json:"issued,omitempty"`
+	Revoked bool       `json:"revoked"`
+	// LastError is the error of the last failed order, cleared by the next successful one
+	LastError string `json:"lastError,omitempty"`
+}
+
+// clientStatus is the answer of GET /status.
+type clientStatus struct {
+	Client       string             `json:"client"`
+	Directory    string             `json:"directory"`
+	Account      string             `json:"account"`
+	Started      time.Time          `json:"started"`
+	Certificates []certificateState `json:"certificates"`
+}
+
+// Status describes the client and its certificate.
+func (c *controller) Status() any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var issued *time.Time
+	if !c.issued.IsZero() {
+		t := c.issued
+		issued = &t
+	}
+	return clientStatus{
+		Client:    network.AcmeClientName + "/" + network.AcmeClientVersion,
+		Directory: c.dirURL,
+		Account:   c.account,
+		Started:   c.started,
+		Certificates: []certificateState{{
+			Name:      c.name(),
+			Domains:   c.domains,
+			Issued:    issued,
+			Revoked:   c.revoked,
+			LastError: c.lastErr,
+		}},
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/admin"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/httpCertif"
+)
+
+func TestController(t *testing.T) {
+	defer func(interval time.Duration) { pollInterval = interval }(pollInterval)
+	pollInterval = 10 * time.Millisecond
+	defer func(m *httpCertif.Manager) { httpCertif.Certificates = m }(httpCertif.Certificates)
+	httpCertif.Certificates = httpCertif.NewManager()
+
+	f := newFakeACME(t, "valid")
+	c := &controller{
+		netState: f.netState(t),
+		dir:      dir{NewOrder: f.URL + "/new-order", RevokeCert: f.URL + "/revoke-cert"},
+		dirURL:   f.URL + "/dir",
+		account:  f.URL + "/account/1",
+		chalCfg:  fakeChallengeConfig(&recordingSolver{}),
+		domains:  []string{"example.com", "www.example.com"},
+		started:  time.Now(),
+	}
+	// Keep the certificate server from listening on its port
+	c.serveOnce.Do(func() {})
+
+	state := func() certificateState {
+		t.Helper()
+		status := c.Status().(clientStatus)
+		if status.Directory != f.URL+"/dir" || len(status.Certificates) != 1 {
+			t.Fatalf("Wrong status: %+v", status)
+		}
+		return status.Certificates[0]
+	}
+	served := func() (*httpCertif.CertificateStatus, []byte) {
+		t.Helper()
+		cert, ok := httpCertif.Certificates.Get("example.com")
+		if !ok {
+			t.Fatal("Certificate not served")
+		}
+		return &httpCertif.Certificates.Status()[0], cert.Certificate[0]
+	}
+
+	if s := state(); s.Issued != nil || s.Revoked {
+		t.Errorf("Wrong status before the first order: %+v", s)
+	}
+	if err := c.Revoke("example.com"); err == nil {
+		t.Error("Revoked without certificate")
+	}
+	if err := c.Renew("example.org"); !errors.Is(err, admin.ErrUnknownName) {
+		t.Errorf("Unknown name renewed: %v", err)
+	}
+
+	if err := c.Renew("example.com"); err != nil {
+		t.Fatalf("Renew failed: %v", err)
+	}
+	if s := state(); s.Issued == nil || s.Revoked || s.LastError != "" {
+		t.Errorf("Wrong status after the order: %+v", s)
+	}
+	_, first := served()
+
+	// A renewal replaces the served certificate
+	if err := c.Renew("example.com"); err != nil {
+		t.Fatalf("Renew failed: %v", err)
+	}
+	status, second := served()
+	if bytes.Equal(first, second) || strings.Join(status.SANs, ",") != "example.com,www.example.com" {
+		t.Errorf("Certificate not renewed: %+v", status)
+	}
+
+	// The revoked certificate is the served one, still served but flagged
+	if err := c.Revoke("example.com"); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if len(f.revoked) != 1 || !bytes.Equal(f.revoked[0], second) {
+		t.Errorf("Wrong certificate revoked")
+	}
+	if status, der := served(); !status.Revoked || !bytes.Equal(der, second) {
+		t.Errorf("Revoked certificate not flagged: %+v", status)
+	}
+	if s := state(); !s.Revoked {
+		t.Errorf("Revocation not reported: %+v", s)
+	}
+	if err := c.Revoke("example.com"); err == nil {
+		t.Error("Certificate revoked twice")
+	}
+
+	// Renewing after a revocation serves a certificate that is not revoked
+	if err := c.Renew("example.com"); err != nil {
+		t.Fatalf("Renew failed: %v", err)
+	}
+	if status, _ := served(); status.Revoked || state().Revoked {
+		t.Errorf("Renewed certificate flagged as revoked: %+v", status)
+	}
+
+	// A failed order is reported in the status
+	f.mu.Lock()
+	f.challengeStatus = "invalid"
+	f.mu.Unlock()
+	c.domains = []string{"example.com", "new.example.com"}
+	if err := c.Renew("example.com"); err == nil {
+		t.Error("Invalid order accepted")
+	}
+	if s := state(); !strings.Contains(s.LastError, "is invalid") {
+		t.Errorf("Failed order not reported: %+v", s)
+	}
+}
+
+func TestControllerFinalize(t *testing.T) {
+	defer func(interval time.Duration) { pollInterval = interval }(pollInterval)
+	pollInterval = 10 * time.Millisecond
+
+	f := newFakeACME(t, "valid")
+	c := &controller{
+		netState: f.netState(t),
+		dir:      dir{NewOrder: f.URL + "/new-order"},
+		chalCfg:  fakeChallengeConfig(&recordingSolver{}),
+		domains:  []string{"example.com"},
+	}
+
+	// A rejected CSR fails the order with the problem of the CA, and so does an order left ready after finalize
+	for finalize, want := range map[string]string{"reject": "CSR rejected", "ignore": "still ready"} {
+		f.mu.Lock()
+		f.finalize = finalize
+		f.mu.Unlock()
+		if _, _, err := c.order(context.Background()); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Finalize %v: %v", finalize, err)
+		}
+	}
+}
+
+func TestControllerStapleUnlocked(t *testing.T) {
+	defer func(interval time.Duration) { pollInterval = interval }(pollInterval)
+	pollInterval = 10 * time.Millisecond
+	defer func(m *httpCertif.Manager) { httpCertif.Certificates = m }(httpCertif.Certificates)
+	httpCertif.Certificates = httpCertif.NewManager()
+
+	// The OCSP responder hangs until the ACME lock is checked
+	fetching, release := make(chan struct{}), make(chan struct{})
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(fetching)
+		<-release
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer responder.Close()
+	httpCertif.Certificates.ConfigureOCSP(httpCertif.OCSPConfig{Enabled: true, Responder: responder.URL})
+
+	f := newFakeACME(t, "valid")
+	c := &controller{
+		netState: f.netState(t),
+		dir:      dir{NewOrder: f.URL + "/new-order"},
+		chalCfg:  fakeChallengeConfig(&recordingSolver{}),
+		domains:  []string{"example.com"},
+	}
+	c.serveOnce.Do(func() {})
+
+	done := make(chan error)
+	go func() { done <- c.Renew("example.com") }()
+	<-fetching
+	if !c.acme.TryLock() {
+		t.Error("ACME requests blocked while fetching the OCSP staple")
+	} else {
+		c.acme.Unlock()
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("Renew failed: %v", err)
+	}
+	if _, ok := httpCertif.Certificates.Get("example.com"); !ok {
+		t.Error("Certificate not served without staple")
+	}
+}
@@ -15,15 +15,18 @@ type profile struct {
 }
 
 type meta struct {
-	ExternalAccountRequired bool    `json:"externalAccountRequired"`
-	Profiles                profile `json:"profiles"`
-	TermsOfService          string  `json:"termsOfService"`
+	CaaIdentities           []string `json:"caaIdentities"`
+	ExternalAccountRequired bool     `json:"externalAccountRequired"`
+	Profiles                profile  `json:"profiles"`
+	TermsOfService          string   `json:"termsOfService"`
+	Website                 string   `json:"website"`
 }
 
 type dir struct {
 	KeyChange   string `json:"keyChange"`
 	Meta        meta   `json:"meta"`
 	NewAccount  string `json:"newAccount"`
+	NewAuthz    string `json:"newAuthz"`
 	NewNonce    string `json:"newNonce"`
 	NewOrder    string `json:"newOrder"`
 	RenewalInfo string `json:"renewalInfo"`
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/dns01"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// captureFilter selects the records of a DNS capture, empty fields match every record
+type captureFilter struct {
+	name   string
+	qtype  string
+	rcode  string
+	source string
+}
+
+// matches tells whether rec passes every filter.
+func (f captureFilter) matches(rec dns01.QueryRecord) bool {
+	if f.name != "" && !dns.IsSubDomain(dns.Fqdn(f.name), rec.Name) {
+		return false
+	}
+	if f.qtype != "" && !strings.EqualFold(f.qtype, rec.Type) {
+		return false
+	}
+	if f.rcode != "" && !strings.EqualFold(f.rcode, rec.Rcode) {
+		return false
+	}
+	if f.source != "" {
+		host, _, err := net.SplitHostPort(rec.Source)
+		if err != nil || host != f.source {
+			return false
+		}
+	}
+	return true
+}
+
+// dnsLog prints the records of a DNS capture file matching the filters of args, optionally replaying their queries.
+func dnsLog(args []string) {
+	flags := flag.NewFlagSet("dns-log", flag.ExitOnError)
+	file := flags.String("file", "dns-capture.jsonl", "DNS capture file written with --dns-capture (optional)")
+	name := flags.String("name", "", "Only show the queries of this name and its subdomains (optional)")
+	qtype := flags.String("type", "", "Only show the queries of this type, e.g. TXT (optional)")
+	rcode := flags.String("rcode", "", "Only show the answers with this rcode, e.g. NXDOMAIN (optional)")
+	source := flags.String("source", "", "Only show the queries sent from this IP (optional)")
+	replay := flags.String("replay", "", "Send the shown queries again to the DNS server HOST:PORT and compare the answers (optional)")
+	verbose := flags.Bool("verbose", false, "Print the full captured answers (optional; default false)")
+	if err := flags.Parse(args); err != nil {
+		log.Fatalf("Error parsing flags: %v", err)
+	}
+
+	capture, err := os.Open(*file)
+	if err != nil {
+		log.Fatalf("Failed to open DNS capture: %v", err)
+	}
+	defer capture.Close()
+
+	filter := captureFilter{name: *name, qtype: *qtype, rcode: *rcode, source: *source}
+	err = dns01.ReadCapture(capture, func(rec dns01.QueryRecord) error {
+		if !filter.matches(rec) {
+			return nil
+		}
+		fmt.Printf("%v %v\n", rec.Time.Format("2006-01-02T15:04:05.000Z07:00"), rec)
+
+		captured := new(dns.Msg)
+		if err := captured.Unpack(rec.Response); err != nil {
+			fmt.Printf("  invalid captured answer: %v\n", err)
+			return nil
+		}
+		if *verbose {
+			fmt.Println(indent(captured.String()))
+		}
+		if *replay != "" {
+			replayQuery(*replay, rec, captured)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Failed to read DNS capture: %v", err)
+	}
+}
+
+// replayQuery sends the query of rec to server and prints whether its answer differs from the captured one.
+func replayQuery(server string, rec dns01.QueryRecord, captured *dns.Msg) {
+	query := new(dns.Msg)
+	if err := query.Unpack(rec.Query); err != nil {
+		fmt.Printf("  invalid captured query: %v\n", err)
+		return
+	}
+
+	client := &dns.Client{Net: rec.Net}
+	res, _, err := client.Exchange(query, server)
+	if err != nil {
+		fmt.Printf("  replay failed: %v\n", err)
+		return
+	}
+
+	verdict := "same answer"
+	if !dns01.SameAnswer(res, captured) {
+		verdict = "different answer"
+	}
+	fmt.Printf("  replay: %v, %v answers, %v\n", dns.RcodeToString[res.Rcode], len(res.Answer), verdict)
+}
+
+// indent prefixes every line of s with two spaces.
+func indent(s string) string {
+	return "  " + strings.ReplaceAll(strings.TrimSuffix(s, "\n"), "\n", "\n  ")
+}
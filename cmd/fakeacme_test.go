@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/crypto"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/network"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/solver"
+)
+
+// fakeACME is a minimal ACME server whose http-01 challenges turn into challengeStatus once triggered. Its orders are
+// issued by a test CA as soon as they are finalized.
+type fakeACME struct {
+	*httptest.Server
+	challengeStatus string
+	caKey           *ecdsa.PrivateKey
+	ca              *x509.Certificate
+
+	mu sync.Mutex
+	// triggered records the identifiers whose challenge was posted, posts how many times
+	triggered map[string]bool
+	posts     map[string]int
+	// initial is the status of the challenge of an identifier before it is posted, pending when missing. A
+	// processing challenge turns into challengeStatus once polled.
+	initial map[string]string
+	// orders are the identifiers of each order, certificates the PEM chain of the finalized ones
+	orders       [][]string
+	certificates map[int]string
+	// revoked lists the DER certificates revoked
+	revoked [][]byte
+	// finalize is how finalize requests are answered: issued when empty, rejected with badCSR on "reject", and
+	// accepted but never issued on "ignore"
+	finalize string
+}
+
+func newFakeACME(t *testing.T, challengeStatus string) *fakeACME {
+	f := &fakeACME{challengeStatus: challengeStatus, triggered: make(map[string]bool), posts: make(map[string]int),
+		initial: make(map[string]string), certificates: make(map[int]string)}
+	f.caKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, _ := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &f.caKey.PublicKey, f.caKey)
+	f.ca, _ = x509.ParseCertificate(caDER)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /new-authz", func(w http.ResponseWriter, r *http.Request) {
+		var req newAuthz
+		if err := json.Unmarshal(jwsPayload(t, r), &req); err != nil {
+			t.Errorf("Invalid newAuthz payload: %v", err)
+		}
+		w.Header().Set("Location", f.URL+"/authz/"+req.Identifier.Value)
+		f.writeAuthz(w, http.StatusCreated, req.Identifier.Value)
+	})
+	mux.HandleFunc("POST /authz/{name}", func(w http.ResponseWriter, r *http.Request) {
+		f.writeAuthz(w, http.StatusOK, r.PathValue("name"))
+	})
+	mux.HandleFunc("POST /chall/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		// Posting {} triggers the validation, an empty payload only polls
+		f.mu.Lock()
+		if len(jwsPayload(t, r)) > 0 {
+			f.triggered[name] = true
+			f.posts[name]++
+		} else if f.initial[name] == "processing" {
+			f.initial[name] = f.challengeStatus
+		}
+		f.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(f.challenge(name))
+	})
+
+	mux.HandleFunc("POST /new-order", func(w http.ResponseWriter, r *http.Request) {
+		var req newOrder
+		if err := json.Unmarshal(jwsPayload(t, r), &req); err != nil {
+			t.Errorf("Invalid newOrder payload: %v", err)
+		}
+		var names []string
+		for _, identifier := range req.Identifiers {
+			names = append(names, identifier.Value)
+		}
+		f.mu.Lock()
+		f.orders = append(f.orders, names)
+		id := len(f.orders) - 1
+		f.mu.Unlock()
+		w.Header().Set("Location", fmt.Sprintf("%v/order/%v", f.URL, id))
+		f.writeOrder(w, http.StatusCreated, id)
+	})
+	mux.HandleFunc("POST /order/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.Atoi(r.PathValue("id"))
+		f.writeOrder(w, http.StatusOK, id)
+	})
+	mux.HandleFunc("POST /finalize/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.Atoi(r.PathValue("id"))
+		var req postCsr
+		if err := json.Unmarshal(jwsPayload(t, r), &req); err != nil {
+			t.Errorf("Invalid finalize payload: %v", err)
+		}
+		der, _ := base64.RawURLEncoding.DecodeString(req.Csr)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			t.Errorf("Invalid CSR: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		finalize := f.finalize
+		f.mu.Unlock()
+		switch finalize {
+		case "reject":
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(acmeProblem{Type: "urn:ietf:params:acme:error:badCSR", Detail: "CSR rejected"})
+			return
+		case "":
+			f.issue(t, id, csr)
+		}
+		f.writeOrder(w, http.StatusOK, id)
+	})
+	mux.HandleFunc("POST /cert/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.Atoi(r.PathValue("id"))
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_, _ = io.WriteString(w, f.certificates[id])
+	})
+	mux.HandleFunc("POST /revoke-cert", func(w http.ResponseWriter, r *http.Request) {
+		var req revoke
+		if err := json.Unmarshal(jwsPayload(t, r), &req); err != nil {
+			t.Errorf("Invalid revokeCert payload: %v", err)
+		}
+		der, _ := base64.RawURLEncoding.DecodeString(req.Certificate)
+		f.mu.Lock()
+		f.revoked = append(f.revoked, der)
+		f.mu.Unlock()
+	})
+
+	f.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// jwsPayload returns the decoded payload of the JWS request r.
+func jwsPayload(t *testing.T, r *http.Request) []byte {
+	body, _ := io.ReadAll(r.Body)
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+	if err := json.Unmarshal(body, &jws); err != nil {
+		t.Errorf("Invalid JWS: %v", err)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		t.Errorf("Invalid JWS payload: %v", err)
+	}
+	return payload
+}
+
+// challenge returns the http-01 challenge of name in its current state.
+func (f *fakeACME) challenge(name string) challenge {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	chal := challenge{Type: "http-01", Url: f.URL + "/chall/" + name, Token: "token-" + name, Status: "pending"}
+	if status, ok := f.initial[name]; ok {
+		chal.Status = status
+	}
+	if f.triggered[name] {
+		chal.Status = f.challengeStatus
+	}
+	if chal.Status == "invalid" {
+		chal.Error = &acmeProblem{
+			Type:   "urn:ietf:params:acme:error:unauthorized",
+			Detail: fmt.Sprintf("Invalid response from http://%v/.well-known/acme-challenge/%v", name, chal.Token),
+		}
+	}
+	return chal
+}
+
+// writeAuthz answers with the authorization of name, whose status is the one of its challenge once finished.
+func (f *fakeACME) writeAuthz(w http.ResponseWriter, status int, name string) {
+	chal := f.challenge(name)
+	authz := challengesList{Status: chal.Status, Challenges: []challenge{chal}}
+	if chal.Status == "processing" {
+		authz.Status = "pending"
+	}
+	authz.Identifier.Type, authz.Identifier.Value = "dns", name
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(authz)
+}
+
+// postCount returns how many times the challenge of name was posted.
+func (f *fakeACME) postCount(name string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.posts[name]
+}
+
+// issue signs the certificate of order id requested by csr, with the identifiers of the order.
+func (f *fakeACME) issue(t *testing.T, id int, csr *x509.CertificateRequest) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(id) + 2),
+		DNSNames:     f.orders[id],
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, f.ca, csr.PublicKey, f.caKey)
+	if err != nil {
+		t.Errorf("Could not issue the certificate: %v", err)
+		return
+	}
+	f.certificates[id] = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})) +
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.ca.Raw}))
+}
+
+// writeOrder answers with order id, ready once its authorizations are valid and valid once its certificate is issued.
+func (f *fakeACME) writeOrder(w http.ResponseWriter, status int, id int) {
+	f.mu.Lock()
+	order := Order{Status: "pending", Finalize: fmt.Sprintf("%v/finalize/%v", f.URL, id)}
+	for _, name := range f.orders[id] {
+		order.Identifiers = append(order.Identifiers, identifiers{Type: "dns", Value: name})
+		order.Authorizations = append(order.Authorizations, f.URL+"/authz/"+name)
+	}
+	_, issued := f.certificates[id]
+	f.mu.Unlock()
+	if issued {
+		order.Status, order.Certificate = "valid", fmt.Sprintf("%v/cert/%v", f.URL, id)
+	} else if !slices.ContainsFunc(order.Identifiers, func(id identifiers) bool { return f.challenge(id.Value).Status != "valid" }) {
+		order.Status = "ready"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(order)
+}
+
+// netState returns the state of an account of f.
+func (f *fakeACME) netState(t *testing.T) *network.StateNetwork {
+	pKey, err := crypto.GenerateNewKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPool := x509.NewCertPool()
+	certPool.AddCert(f.Certificate())
+	netState := network.NewStateNetwork(pKey, certPool, f.URL+"/account/1")
+	_ = netState.SetNonce("nonce")
+	return &netState
+}
+
+// recordingSolver records the tokens presented and not cleaned up yet.
+type recordingSolver struct {
+	mu        sync.Mutex
+	presented map[string]string
+}
+
+func (s *recordingSolver) Present(_ context.Context, _, token, keyAuth string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.presented == nil {
+		s.presented = make(map[string]string)
+	}
+	s.presented[token] = keyAuth
+	return nil
+}
+
+func (s *recordingSolver) CleanUp(_ context.Context, _, token, _ string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.presented, token)
+	return nil
+}
+
+// fakeChallengeConfig answers the http-01 challenges with s.
+func fakeChallengeConfig(s solver.Solver) challengeConfig {
+	registry := solver.NewRegistry()
+	registry.Register(solver.TypeHTTP01, s)
+	return challengeConfig{registry: registry, defaultType: solver.TypeHTTP01, thumbprint: "thumb"}
+}
@@ -23,6 +23,8 @@ type Order struct {
 	NotAfter       time.Time     `json:"notAfter"`
 	Authorizations []string      `json:"authorizations"`
 	Certificate    string        `json:"certificate"`
+	// Error is the problem that made the order invalid
+	Error *acmeProblem `json:"error"`
 }
 
 type newOrder struct {
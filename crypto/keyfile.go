@@ -0,0 +1,70 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+)
+
+// SaveKeys writes the private key to path as a PEM encoded EC PRIVATE KEY, readable only by the owner.
+func SaveKeys(path string, pKey *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(pKey)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+}
+
+// LoadKeys reads a PEM encoded ECDSA private key (SEC 1 or PKCS #8) from path.
+func LoadKeys(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	blk, _ := pem.Decode(data)
+	if blk == nil {
+		return nil, errors.New("no PEM block found in " + path)
+	}
+
+	if pKey, err := x509.ParseECPrivateKey(blk.Bytes); err == nil {
+		return pKey, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(blk.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	pKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key in " + path + " is not an ECDSA key")
+	}
+
+	return pKey, nil
+}
+
+// LoadOrGenerateKeys returns the key stored at path, or generates and stores a new one if the file does not exist yet.
+func LoadOrGenerateKeys(path string) (*ecdsa.PrivateKey, error) {
+	pKey, err := LoadKeys(path)
+	if err == nil {
+		return pKey, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	pKey, err = GenerateNewKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := SaveKeys(path, pKey); err != nil {
+		return nil, err
+	}
+
+	return pKey, nil
+}
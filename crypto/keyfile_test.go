@@ -0,0 +1,51 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOrGenerateKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "certificate.key")
+
+	pKey, err := LoadOrGenerateKeys(path)
+	if err != nil {
+		t.Fatalf("LoadOrGenerateKeys failed: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Key file not private: %v %v", info, err)
+	}
+
+	again, err := LoadOrGenerateKeys(path)
+	if err != nil || !again.Equal(pKey) {
+		t.Errorf("Stored key not reused: %v", err)
+	}
+}
+
+func TestLoadKeysPKCS8(t *testing.T) {
+	pKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(pKey)
+	path := filepath.Join(t.TempDir(), "pkcs8.key")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadKeys(path)
+	if err != nil || !loaded.Equal(pKey) {
+		t.Errorf("PKCS #8 key not loaded: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadOrGenerateKeys(path); err == nil {
+		t.Errorf("Invalid key file overwritten or accepted")
+	}
+}
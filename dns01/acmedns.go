@@ -0,0 +1,344 @@
+package dns01
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/httpjson"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/logger"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/solver"
+	"io"
+	"io/fs"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// ACMEDNSServer store the acme-dns API server object. Used to shut down from outside context.
+var ACMEDNSServer *http.Server
+
+// acmeDNSKeptValues number of TXT values served per registration, so that a wildcard and its base name can be
+// validated at the same time
+const acmeDNSKeptValues = 2
+
+// acmeDNSPasswordLength length of the generated passwords, as in acme-dns
+const acmeDNSPasswordLength = 40
+
+// base64URLChars alphabet of base64url, used by the generated passwords and the TXT values
+const base64URLChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_"
+
+// ACMEDNSConfig configures the acme-dns compatible API.
+type ACMEDNSConfig struct {
+	// Listen is the host:port of the HTTP API
+	Listen string
+	// Domain is the parent of the registration subdomains, it must be served by this DNS server
+	Domain string
+	// Storage is the JSON file keeping the registrations across restarts
+	Storage string
+}
+
+// acmeDNSRegistration is an account of the acme-dns API.
+type acmeDNSRegistration struct {
+	Username string `json:"username"`
+	// PasswordHash is the hex encoded SHA-256 of PasswordSalt and the password, which is only returned by the
+	// registration
+	PasswordHash string   `json:"password_hash"`
+	PasswordSalt string   `json:"password_salt"`
+	Subdomain    string   `json:"subdomain"`
+	AllowFrom    []string `json:"allowfrom"`
+	// TXT are the last published values, oldest first
+	TXT []string `json:"txt"`
+}
+
+// acmeDNSAPI serves the /register and /update endpoints of acme-dns on top of the challenge TXT records.
+type acmeDNSAPI struct {
+	cfg ACMEDNSConfig
+
+	// mu protects registrations and the storage file
+	mu            sync.Mutex
+	registrations map[string]*acmeDNSRegistration
+}
+
+// newACMEDNSAPI loads the registrations of cfg.Storage and publishes their TXT values.
+func newACMEDNSAPI(cfg ACMEDNSConfig) (*acmeDNSAPI, error) {
+	cfg.Domain = strings.ToLower(strings.TrimSuffix(cfg.Domain, "."))
+	api := &acmeDNSAPI{cfg: cfg, registrations: make(map[string]*acmeDNSRegistration)}
+
+	data, err := os.ReadFile(cfg.Storage)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		var registrations []*acmeDNSRegistration
+		if err := json.Unmarshal(data, &registrations); err != nil {
+			return nil, fmt.Errorf("invalid acme-dns storage %v: %w", cfg.Storage, err)
+		}
+		for _, reg := range registrations {
+			api.registrations[reg.Username] = reg
+			for _, value := range reg.TXT {
+				api.publish(reg, value)
+			}
+		}
+	}
+	logger.Logger().Debug().Msgf("Loaded %v acme-dns registrations", len(api.registrations))
+
+	return api, nil
+}
+
+// fullDomain returns the name serving the TXT records of reg, without trailing dot.
+func (api *acmeDNSAPI) fullDomain(reg *acmeDNSRegistration) string {
+	return reg.Subdomain + "." + api.cfg.Domain
+}
+
+// publish serves value as a TXT record of reg, until it is replaced by newer values.
+func (api *acmeDNSAPI) publish(reg *acmeDNSRegistration, value string) {
+	tokens.Add(solver.Token{
+		Domain: strings.ToLower(dns.Fqdn(api.fullDomain(reg))),
+		Token:  value,
+		Value:  value,
+	})
+}
+
+// save writes the registrations to the storage file, replacing it atomically.
+func (api *acmeDNSAPI) save() error {
+	registrations := make([]*acmeDNSRegistration, 0, len(api.registrations))
+	for _, reg := range api.registrations {
+		registrations = append(registrations, reg)
+	}
+	data, err := json.MarshalIndent(registrations, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(api.cfg.Storage), ".acmedns-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), api.cfg.Storage)
+}
+
+func (api *acmeDNSAPI) register(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		AllowFrom []string `json:"allowfrom"`
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err != nil || (len(body) > 0 && json.Unmarshal(body, &req) != nil) {
+		httpjson.WriteError(w, http.StatusBadRequest, "malformed_json_payload")
+		return
+	}
+	for _, cidr := range req.AllowFrom {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			httpjson.WriteError(w, http.StatusBadRequest, "invalid_allowfrom_cidr")
+			return
+		}
+	}
+
+	username, err := newUUID()
+	if err != nil {
+		httpjson.WriteError(w, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	subdomain, err := newUUID()
+	if err != nil {
+		httpjson.WriteError(w, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	password, err := newPassword()
+	if err != nil {
+		httpjson.WriteError(w, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		httpjson.WriteError(w, http.StatusInternalServerError, "internal_error")
+		return
+	}
+
+	reg := &acmeDNSRegistration{
+		Username:     username,
+		PasswordHash: hashPassword(hex.EncodeToString(salt), password),
+		PasswordSalt: hex.EncodeToString(salt),
+		Subdomain:    subdomain,
+		AllowFrom:    append([]string{}, req.AllowFrom...),
+	}
+
+	api.mu.Lock()
+	api.registrations[username] = reg
+	err = api.save()
+	api.mu.Unlock()
+	if err != nil {
+		logger.Logger().Error().Msgf("Could not save acme-dns registration: %v", err)
+		httpjson.WriteError(w, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	logger.Logger().Info().Msgf("acme-dns registration %v for %v", username, api.fullDomain(reg))
+
+	httpjson.Write(w, http.StatusCreated, map[string]any{
+		"username":   username,
+		"password":   password,
+		"fulldomain": api.fullDomain(reg),
+		"subdomain":  subdomain,
+		"allowfrom":  reg.AllowFrom,
+	})
+}
+
+func (api *acmeDNSAPI) update(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Subdomain string `json:"subdomain"`
+		TXT       string `json:"txt"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil {
+		httpjson.WriteError(w, http.StatusBadRequest, "malformed_json_payload")
+		return
+	}
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	reg, ok := api.registrations[r.Header.Get("X-Api-User")]
+	if !ok || !checkPassword(reg, r.Header.Get("X-Api-Key")) {
+		httpjson.WriteError(w, http.StatusUnauthorized, "forbidden")
+		return
+	}
+	if !strings.EqualFold(req.Subdomain, reg.Subdomain) {
+		httpjson.WriteError(w, http.StatusUnauthorized, "forbidden")
+		return
+	}
+	if !allowedFrom(reg.AllowFrom, r.RemoteAddr) {
+		httpjson.WriteError(w, http.StatusUnauthorized, "forbidden")
+		return
+	}
+	if !validTXT(req.TXT) {
+		httpjson.WriteError(w, http.StatusBadRequest, "bad_txt")
+		return
+	}
+
+	// A retried value only becomes the newest one, a duplicate would remove it from DNS once evicted
+	reg.TXT = append(slices.DeleteFunc(reg.TXT, func(value string) bool { return value == req.TXT }), req.TXT)
+	api.publish(reg, req.TXT)
+	for len(reg.TXT) > acmeDNSKeptValues {
+		tokens.Remove(strings.ToLower(dns.Fqdn(api.fullDomain(reg))), reg.TXT[0])
+		reg.TXT = reg.TXT[1:]
+	}
+	if err := api.save(); err != nil {
+		logger.Logger().Error().Msgf("Could not save acme-dns update: %v", err)
+	}
+	logger.Logger().Debug().Msgf("acme-dns TXT updated for %v: %v", api.fullDomain(reg), req.TXT)
+
+	httpjson.Write(w, http.StatusOK, map[string]string{"txt": req.TXT})
+}
+
+// allowedFrom tells whether remoteAddr belongs to one of the networks of allowFrom, every address is allowed when it
+// is empty.
+func allowedFrom(allowFrom []string, remoteAddr string) bool {
+	if len(allowFrom) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, cidr := range allowFrom {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// validTXT tells whether value is a dns-01 TXT value: a base64url encoded SHA-256 digest.
+func validTXT(value string) bool {
+	if len(value) != 43 {
+		return false
+	}
+	for _, c := range value {
+		if !strings.ContainsRune(base64URLChars, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// hashPassword returns the hex encoded SHA-256 of salt and password. The generated passwords are random enough for a
+// single hash.
+func hashPassword(salt string, password string) string {
+	sum := sha256.Sum256([]byte(salt + password))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkPassword tells whether password is the one of reg, in constant time.
+func checkPassword(reg *acmeDNSRegistration, password string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashPassword(reg.PasswordSalt, password)), []byte(reg.PasswordHash)) == 1
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// newPassword returns a random password of acmeDNSPasswordLength characters.
+func newPassword() (string, error) {
+	password := make([]byte, acmeDNSPasswordLength)
+	for i := range password {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(base64URLChars))))
+		if err != nil {
+			return "", err
+		}
+		password[i] = base64URLChars[n.Int64()]
+	}
+	return string(password), nil
+}
+
+// handler routes the acme-dns endpoints.
+func (api *acmeDNSAPI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /register", api.register)
+	mux.HandleFunc("POST /update", api.update)
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	return mux
+}
+
+// ACMEDNS serves the acme-dns compatible API, whose TXT records are answered by the DNS server under cfg.Domain.
+func ACMEDNS(cfg ACMEDNSConfig) {
+	api, err := newACMEDNSAPI(cfg)
+	if err != nil {
+		logger.Logger().Error().Msgf("Could not load acme-dns registrations: %v", err)
+		return
+	}
+
+	ACMEDNSServer = &http.Server{
+		Addr:    cfg.Listen,
+		Handler: api.handler(),
+	}
+	if err := ACMEDNSServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Logger().Error().Msgf("Could not start acme-dns server: %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package dns01
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestACMEDNS(t *testing.T) {
+	cfg := ACMEDNSConfig{Domain: "auth.example.org", Storage: filepath.Join(t.TempDir(), "acmedns.json")}
+	api, err := newACMEDNSAPI(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CleanUpAll()
+
+	rec := httptest.NewRecorder()
+	api.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/register", nil))
+	var reg struct{ Username, Password, Fulldomain, Subdomain string }
+	if rec.Code != http.StatusCreated || json.Unmarshal(rec.Body.Bytes(), &reg) != nil {
+		t.Fatalf("Registration failed: %v %v", rec.Code, rec.Body)
+	}
+
+	update := func(key string, txt string) int {
+		req := httptest.NewRequest(http.MethodPost, "/update", strings.NewReader(`{"subdomain":"`+reg.Subdomain+`","txt":"`+txt+`"}`))
+		req.Header.Set("X-Api-User", reg.Username)
+		req.Header.Set("X-Api-Key", key)
+		rec := httptest.NewRecorder()
+		api.handler().ServeHTTP(rec, req)
+		return rec.Code
+	}
+	values := []string{strings.Repeat("a", 43), strings.Repeat("b", 43), strings.Repeat("c", 43)}
+	if code := update("wrong", values[0]); code != http.StatusUnauthorized {
+		t.Errorf("Wrong password accepted: %v", code)
+	}
+	if code := update(reg.Password, "short"); code != http.StatusBadRequest {
+		t.Errorf("Invalid TXT accepted: %v", code)
+	}
+	for _, value := range values {
+		if code := update(reg.Password, value); code != http.StatusOK {
+			t.Fatalf("Update failed: %v", code)
+		}
+	}
+
+	if m := query(dns.Fqdn(reg.Fulldomain), dns.TypeTXT); len(m.Answer) != 2 {
+		t.Errorf("Expected the last two values: %v", m.Answer)
+	}
+
+	// A retried value is not evicted with its duplicate
+	for _, value := range []string{values[2], values[0]} {
+		if code := update(reg.Password, value); code != http.StatusOK {
+			t.Fatalf("Update failed: %v", code)
+		}
+	}
+	txt := func() []string {
+		var served []string
+		for _, rr := range query(dns.Fqdn(reg.Fulldomain), dns.TypeTXT).Answer {
+			served = append(served, rr.(*dns.TXT).Txt[0])
+		}
+		slices.Sort(served)
+		return served
+	}
+	if served := txt(); !slices.Equal(served, []string{values[0], values[2]}) {
+		t.Errorf("Retried value not served: %v", served)
+	}
+
+	// The registrations and their values survive a restart
+	CleanUpAll()
+	if _, err := newACMEDNSAPI(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if served := txt(); !slices.Equal(served, []string{values[0], values[2]}) {
+		t.Errorf("Values not restored: %v", served)
+	}
+
+	// Only a salted hash of the password is stored
+	data, _ := os.ReadFile(cfg.Storage)
+	if strings.Contains(string(data), reg.Password) || !strings.Contains(string(data), `"password_salt"`) {
+		t.Errorf("Password not hashed: %s", data)
+	}
+	if code := update(reg.Password[:len(reg.Password)-1], values[0]); code != http.StatusUnauthorized {
+		t.Errorf("Password prefix accepted: %v", code)
+	}
+}
@@ -1,54 +1,98 @@
 package dns01
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/logger"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/solver"
+	"net"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
-// Server store the server object. Used to shut down from outside context.
-var Server *dns.Server
+// Servers store the server objects, one per listener. Used to shut down from outside context.
+var Servers []*dns.Server
+
+// serversMu Mutex to protect access to Servers
+var serversMu sync.Mutex
+
+// DefaultListeners listen for UDP and TCP on port 10053, as expected by the CI
+var DefaultListeners = []Listener{
+	{Net: "udp", Addr: "0.0.0.0:10053"},
+	{Net: "tcp", Addr: "0.0.0.0:10053"},
+}
+
+// maxUDPSize largest UDP answer, whatever the EDNS0 buffer size announced by the client (DNS flag day 2020)
+const maxUDPSize = 1232
 
 // dnsARecord A record use by the CI to map the IP to the domain
-var dnsARecord = ""
+var dnsARecord net.IP
+
+// dnsAAAARecord AAAA record returned for every domain, none when nil
+var dnsAAAARecord net.IP
+
+// caaRecords CAA records served outside the zones, keyed by lower case fully qualified name
+var caaRecords map[string][]dns.RR
+
+// hostAddresses per-name addresses overriding dnsARecord and dnsAAAARecord, keyed by lower case fully qualified name
+var hostAddresses map[string][]net.IP
 
-// tokensList list of TXT record for the ACME Protocol
-var tokensList []string
+// delegations CNAME targets of the delegated challenge names, keyed by lower case owner name (_acme-challenge.<domain>.)
+var delegations map[string]string
 
-// mu Mutex to protect access to the list
-var mu sync.RWMutex
+// zones served authoritatively
+var zones []*Zone
+
+// tokens TXT records for the ACME Protocol, keyed by owner name (_acme-challenge.<domain>. or its delegated target) and
+// challenge token
+var tokens = solver.NewTokenStore()
+
+// challengeLabel first label of the names carrying the dns-01 TXT records
+const challengeLabel = "_acme-challenge."
+
+// recordTTL TTL of the served records, short since the tokens change with every authorization
+const recordTTL = 60
+
+// expiryCheckInterval how often expired tokens are removed
+const expiryCheckInterval = 1 * time.Minute
 
 func handler(w dns.ResponseWriter, r *dns.Msg) {
 	m := new(dns.Msg).SetReply(r)
+	m.Authoritative = true
+	m.Compress = true
 
-	mu.RLock()
-	defer mu.RUnlock()
+	// Signed answers are only sent to clients asking for them with the DO bit
+	opt := r.IsEdns0()
+	dnssecOK := opt != nil && opt.Do()
 
 	for _, q := range m.Question {
-		// Handle TXT ACME protocol query
-		if q.Qtype == dns.TypeTXT {
-			for _, t := range tokensList {
-				rr, err := dns.NewRR(fmt.Sprintf("_acme-challenge.%s TXT \"%s\"", q.Name, t))
-				if err != nil {
-					logger.Logger().Error().Msgf("Could not create Resource Record: %v", err)
-					continue
-				}
-				m.Answer = append(m.Answer, rr)
-			}
+		s := signerFor(strings.ToLower(q.Name))
+		if s == nil || !s.answerApex(m, q) {
+			answer(m, q)
+		}
+		if s != nil && dnssecOK {
+			s.sign(m, q)
+		}
+	}
 
-			// Handle A protocol query
-		} else if q.Qtype == dns.TypeA {
-			rr, err := dns.NewRR(fmt.Sprintf("%s A "+dnsARecord, q.Name))
-			if err != nil {
-				logger.Logger().Error().Msgf("Could not create Resource Record: %v", err)
-				continue
-			}
-			m.Answer = append(m.Answer, rr)
+	// UDP answers must fit the buffer of the client (512 bytes without EDNS0), otherwise they are truncated with the
+	// TC bit set so that the client retries over TCP
+	size := dns.MaxMsgSize
+	if _, isUDP := w.RemoteAddr().(*net.UDPAddr); isUDP {
+		size = dns.MinMsgSize
+	}
+	if opt != nil {
+		if size != dns.MaxMsgSize {
+			size = min(max(int(opt.UDPSize()), dns.MinMsgSize), maxUDPSize)
 		}
+		m.SetEdns0(maxUDPSize, dnssecOK)
 	}
+	m.Truncate(size)
+	logQuery(w, r, m)
 
 	err := w.WriteMsg(m)
 	if err != nil {
@@ -57,33 +101,339 @@ func handler(w dns.ResponseWriter, r *dns.Msg) {
 	}
 }
 
-func DNS01(tokenChannel <-chan string, ip string) {
+// answer adds the records answering q to m. Delegated challenge names and the challenge TXT records take precedence
+// over the zones, names outside of the zones follow the CI behaviour: names below _acme-challenge only exist while they
+// have TXT records, every other name has the A record of the CI.
+func answer(m *dns.Msg, q dns.Question) {
+	name := strings.ToLower(q.Name)
+
+	// A delegated challenge name only has its CNAME, the target is answered along with it
+	if target, ok := delegations[name]; ok {
+		m.Answer = append(m.Answer, &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: recordTTL},
+			Target: target,
+		})
+		if _, chained := delegations[target]; q.Qtype != dns.TypeCNAME && !chained {
+			answer(m, dns.Question{Name: target, Qtype: q.Qtype, Qclass: q.Qclass})
+		}
+		return
+	}
+
+	challengeName := strings.HasPrefix(name, challengeLabel)
+	txtRecords := tokens.Domain(name)
+	zone := zoneFor(zones, name)
+
+	if len(txtRecords) > 0 {
+		// Handle TXT ACME protocol query
+		if q.Qtype == dns.TypeTXT {
+			for _, t := range txtRecords {
+				m.Answer = append(m.Answer, &dns.TXT{
+					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: recordTTL},
+					Txt: []string{t.Value},
+				})
+			}
+		} else if zone != nil {
+			m.Ns = append(m.Ns, zone.negativeSOA())
+		} else {
+			m.Ns = append(m.Ns, soaFor(name))
+		}
+		return
+	}
+
+	if zone != nil {
+		zone.resolve(m, q, zones)
+		return
+	}
+
+	switch {
+	case challengeName:
+		m.Rcode = dns.RcodeNameError
+		m.Ns = append(m.Ns, soaFor(name))
+
+	// Handle A and AAAA protocol query
+	case (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) && len(addressesFor(name, q.Qtype)) > 0:
+		for _, ip := range addressesFor(name, q.Qtype) {
+			hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: recordTTL}
+			if q.Qtype == dns.TypeA {
+				m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip})
+			} else {
+				m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+
+	// Handle CAA protocol query
+	case q.Qtype == dns.TypeCAA && len(caaRecords[name]) > 0:
+		for _, rr := range caaRecords[name] {
+			cp := dns.Copy(rr)
+			cp.Header().Name = q.Name
+			m.Answer = append(m.Answer, cp)
+		}
+
+	// The name exists but has no record of this type
+	default:
+		m.Ns = append(m.Ns, soaFor(name))
+	}
+}
+
+// nameExists reports whether answer considers that name exists.
+func nameExists(name string) bool {
+	if _, ok := delegations[name]; ok || len(tokens.Domain(name)) > 0 {
+		return true
+	}
+	if zone := zoneFor(zones, name); zone != nil {
+		return zone.exists(name)
+	}
+	if s := signerFor(name); s != nil && s.Zone == name {
+		return true
+	}
+	return !strings.HasPrefix(name, challengeLabel)
+}
 
+// typesAt returns the types of the records answer serves at name.
+func typesAt(name string) []uint16 {
+	if _, ok := delegations[name]; ok {
+		return []uint16{dns.TypeCNAME}
+	}
+	var types []uint16
+	if len(tokens.Domain(name)) > 0 {
+		types = append(types, dns.TypeTXT)
+	}
+	if zone := zoneFor(zones, name); zone != nil {
+		return append(types, zone.types(name)...)
+	}
+	if s := signerFor(name); s != nil && s.Zone == name {
+		types = append(types, dns.TypeSOA)
+	}
+	if strings.HasPrefix(name, challengeLabel) {
+		return types
+	}
+	if len(addressesFor(name, dns.TypeA)) > 0 {
+		types = append(types, dns.TypeA)
+	}
+	if len(addressesFor(name, dns.TypeAAAA)) > 0 {
+		types = append(types, dns.TypeAAAA)
+	}
+	if len(caaRecords[name]) > 0 {
+		types = append(types, dns.TypeCAA)
+	}
+	return types
+}
+
+// addressesFor returns the addresses of name for qtype (A or AAAA). Per-name addresses of that family take
+// precedence over the addresses returned for every name.
+func addressesFor(name string, qtype uint16) []net.IP {
+	var ips []net.IP
+	for _, ip := range hostAddresses[name] {
+		if (ip.To4() != nil) == (qtype == dns.TypeA) {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) > 0 {
+		return ips
+	}
+
+	if qtype == dns.TypeA && dnsARecord != nil {
+		return []net.IP{dnsARecord}
+	}
+	if qtype == dns.TypeAAAA && dnsAAAARecord != nil {
+		return []net.IP{dnsAAAARecord}
+	}
+	return nil
+}
+
+// soaFor returns the SOA record proving negative answers for name outside of the zones. Each domain is then its own
+// zone apex, unless it is inside a signed zone.
+func soaFor(name string) *dns.SOA {
+	apex := strings.TrimPrefix(name, challengeLabel)
+	if s := signerFor(name); s != nil {
+		apex = s.Zone
+	}
+	if apex == "" {
+		apex = "."
+	}
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: apex, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: recordTTL},
+		Ns:      dns.Fqdn("ns." + strings.TrimSuffix(apex, ".")),
+		Mbox:    dns.Fqdn("hostmaster." + strings.TrimSuffix(apex, ".")),
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  recordTTL,
+	}
+}
+
+// Solver answers dns-01 challenges by serving the key authorization digests as TXT records of the DNS server.
+type Solver struct{}
+
+// Present adds the TXT record of the key authorization to the served records. The record is removed by CleanUp, or
+// once the deadline of ctx is over.
+func (Solver) Present(ctx context.Context, domain, token, keyAuth string) error {
+	tokens.Add(solver.Token{
+		Domain:  ownerName(domain),
+		Token:   token,
+		Value:   solver.DNS01Value(keyAuth),
+		Expires: solver.ExpiryFromContext(ctx),
+	})
+	logger.Logger().Debug().Msgf("Token added for %v: %v", domain, token)
+	return nil
+}
+
+// CleanUp removes the TXT record of the token.
+func (Solver) CleanUp(_ context.Context, domain, token, _ string) error {
+	if tokens.Remove(ownerName(domain), token) {
+		logger.Logger().Debug().Msgf("Token removed for %v: %v", domain, token)
+	}
+	return nil
+}
+
+// ownerName returns the lower case owner name of the TXT record of domain, wildcards use their base name. The record of
+// a delegated domain is published at the target of its CNAME.
+func ownerName(domain string) string {
+	name := strings.ToLower(solver.DNS01Name(domain))
+	if target, ok := delegations[name]; ok {
+		return target
+	}
+	return name
+}
+
+// CleanUpAll removes every TXT record, used when the server stops.
+func CleanUpAll() {
+	for _, t := range tokens.RemoveAll() {
+		logger.Logger().Debug().Msgf("Token removed for %v: %v", t.Domain, t.Token)
+	}
+}
+
+// Listener is a network address the DNS server listens on.
+type Listener struct {
+	// Net is either udp or tcp
+	Net string
+	// Addr is the host:port to listen on, e.g. [::]:53
+	Addr string
+}
+
+// ParseListener parses a listener written as NET:ADDR (e.g. tcp:[::]:10053).
+func ParseListener(value string) (Listener, error) {
+	network, addr, found := strings.Cut(value, ":")
+	if !found || (network != "udp" && network != "tcp") {
+		return Listener{}, fmt.Errorf("invalid DNS listener %q, expected {udp | tcp}:HOST:PORT", value)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return Listener{}, fmt.Errorf("invalid DNS listener %q: %w", value, err)
+	}
+	return Listener{Net: network, Addr: addr}, nil
+}
+
+// Config configures the DNS server.
+type Config struct {
+	// ARecord is the IPv4 returned for A queries of names outside the zones
+	ARecord net.IP
+	// AAAARecord is the IPv6 returned for AAAA queries of names outside the zones, none when nil
+	AAAARecord net.IP
+	// Addresses maps names to the IPv4 and IPv6 addresses returned instead of ARecord and AAAARecord
+	Addresses map[string][]net.IP
+	// CAA records served for names outside the zones
+	CAA []*dns.CAA
+	// Delegations maps identifiers to the name their _acme-challenge name is delegated to with a CNAME, the TXT
+	// records of these identifiers are then served at the delegated name
+	Delegations map[string]string
+	// Signers sign the answers of their zone for clients setting the DO bit
+	Signers []*Signer
+	// Zones are served authoritatively, in addition to the challenge TXT records
+	Zones []*Zone
+	// Listeners the server listens on, all sharing the same handler. DefaultListeners when empty.
+	Listeners []Listener
+	// Capture is a JSON-lines file receiving every query and its answer, none when empty
+	Capture string
+}
+
+// Configure sets the records and the DNSSEC signers the DNS server answers from cfg. It must be called before DNS01 is started: the solver
+// and the handlers then read them without synchronization.
+func Configure(cfg Config) {
+	// Set the DNS Record for A answer
+	dnsARecord = cfg.ARecord
+	dnsAAAARecord = cfg.AAAARecord
+	caaRecords = make(map[string][]dns.RR, len(cfg.CAA))
+	for _, rr := range cfg.CAA {
+		name := strings.ToLower(rr.Hdr.Name)
+		caaRecords[name] = append(caaRecords[name], rr)
+	}
+	hostAddresses = make(map[string][]net.IP, len(cfg.Addresses))
+	for name, ips := range cfg.Addresses {
+		name = strings.ToLower(dns.Fqdn(name))
+		hostAddresses[name] = append(hostAddresses[name], ips...)
+	}
+	delegations = make(map[string]string, len(cfg.Delegations))
+	for identifier, target := range cfg.Delegations {
+		delegations[strings.ToLower(solver.DNS01Name(identifier))] = strings.ToLower(dns.Fqdn(target))
+	}
+	zones = cfg.Zones
+	signers = cfg.Signers
+}
+
+// DNS01 serves the records set by Configure on the listeners of cfg, until Shutdown.
+func DNS01(cfg Config) {
+	// Remove the tokens of authorizations that expired without being cleaned up
 	go func() {
-		for {
-			select {
-			case s := <-tokenChannel: // Receive tokens as normal
-				mu.Lock()
-				tokensList = append(tokensList, s)
-				logger.Logger().Debug().Msgf("Token added: ", s)
-				mu.Unlock()
-			case <-time.After(100 * time.Millisecond): // When done is closed, exit the loop
-				continue
+		for now := range time.Tick(expiryCheckInterval) {
+			for _, t := range tokens.RemoveExpired(now) {
+				logger.Logger().Debug().Msgf("Token expired for %v: %v", t.Domain, t.Token)
 			}
 		}
 	}()
 
-	// Setup DNS Server according to ACME Protocol
-	Server = &dns.Server{
-		Addr:    "0.0.0.0:10053",
-		Net:     "udp",
-		Handler: dns.HandlerFunc(handler),
+	if cfg.Capture != "" {
+		if err := OpenCapture(cfg.Capture); err != nil {
+			logger.Logger().Error().Msgf("Could not open DNS capture file: %v", err)
+		}
 	}
 
-	// Set the DNS Record for A answer
-	dnsARecord = ip
+	listeners := cfg.Listeners
+	if len(listeners) == 0 {
+		listeners = DefaultListeners
+	}
 
-	if err := Server.ListenAndServe(); err != nil {
-		logger.Logger().Error().Msgf("Could not start dns01 server: %v", err)
+	// Setup one DNS Server per listener according to ACME Protocol, only the started ones are shut down
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		srv := &dns.Server{
+			Addr:    l.Addr,
+			Net:     l.Net,
+			Handler: dns.HandlerFunc(handler),
+			UDPSize: maxUDPSize,
+		}
+		srv.NotifyStartedFunc = func() {
+			serversMu.Lock()
+			Servers = append(Servers, srv)
+			serversMu.Unlock()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.ListenAndServe(); err != nil {
+				logger.Logger().Error().Msgf("Could not start dns01 server on %v/%v: %v", srv.Net, srv.Addr, err)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+// Shutdown stops every listener of the DNS server and closes the capture file.
+func Shutdown() error {
+	serversMu.Lock()
+	defer serversMu.Unlock()
+
+	var errs []error
+	for _, srv := range Servers {
+		if err := srv.Shutdown(); err != nil {
+			errs = append(errs, fmt.Errorf("%v/%v: %w", srv.Net, srv.Addr, err))
+		}
+	}
+	Servers = nil
+	if err := CloseCapture(); err != nil {
+		errs = append(errs, fmt.Errorf("capture: %w", err))
 	}
+	return errors.Join(errs...)
 }
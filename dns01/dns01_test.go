@@ -0,0 +1,442 @@
+package dns01
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func query(name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg).SetReply(new(dns.Msg).SetQuestion(name, qtype))
+	m.Authoritative = true
+	answer(m, m.Question[0])
+	return m
+}
+
+func TestChallengeRecords(t *testing.T) {
+	dnsARecord = net.ParseIP("1.2.3.4")
+	hostAddresses = map[string][]net.IP{"api.example.com.": {net.ParseIP("10.0.0.5"), net.ParseIP("2001:db8::5")}}
+	caaRecords = map[string][]dns.RR{"example.com.": {&dns.CAA{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeCAA, Class: dns.ClassINET, Ttl: 3600},
+		Tag: "issue", Value: "pebble.letsencrypt.org; validationmethods=dns-01",
+	}}}
+	defer func() { dnsARecord, hostAddresses, caaRecords = nil, nil, nil }()
+	_ = Solver{}.Present(context.Background(), "*.Example.com", "token1", "keyauth1")
+	_ = Solver{}.Present(context.Background(), "other.org", "token2", "keyauth2")
+	defer CleanUpAll()
+
+	m := query("_acme-challenge.example.com.", dns.TypeTXT)
+	if len(m.Answer) != 1 || m.Answer[0].Header().Name != "_acme-challenge.example.com." {
+		t.Fatalf("Wrong TXT answer: %v", m.Answer)
+	}
+
+	m = query("_acme-challenge.unknown.com.", dns.TypeTXT)
+	if m.Rcode != dns.RcodeNameError || len(m.Ns) != 1 || m.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("Expected NXDOMAIN with SOA: %v", m)
+	}
+
+	m = query("www.example.com.", dns.TypeTXT)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 || len(m.Ns) != 1 {
+		t.Errorf("Expected NODATA with SOA: %v", m)
+	}
+
+	m = query("www.example.com.", dns.TypeA)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "1.2.3.4" {
+		t.Errorf("Wrong A answer: %v", m.Answer)
+	}
+
+	m = query("www.example.com.", dns.TypeAAAA)
+	if len(m.Answer) != 0 || len(m.Ns) != 1 {
+		t.Errorf("Expected NODATA without --record6: %v", m)
+	}
+
+	m = query("API.example.com.", dns.TypeAAAA)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.AAAA).AAAA.String() != "2001:db8::5" {
+		t.Errorf("Wrong per-name AAAA answer: %v", m.Answer)
+	}
+
+	m = query("Example.com.", dns.TypeCAA)
+	if len(m.Answer) != 1 || m.Answer[0].Header().Name != "Example.com." {
+		t.Errorf("Wrong CAA answer: %v", m.Answer)
+	}
+
+	_ = Solver{}.CleanUp(context.Background(), "other.org", "token2", "keyauth2")
+	if m = query("_acme-challenge.other.org.", dns.TypeTXT); m.Rcode != dns.RcodeNameError {
+		t.Errorf("Token was not removed: %v", m)
+	}
+}
+
+func TestDelegation(t *testing.T) {
+	delegations = map[string]string{"_acme-challenge.example.com.": "abc123.acme.internal."}
+	defer func() { delegations = nil }()
+	_ = Solver{}.Present(context.Background(), "*.example.com", "token", "keyauth")
+	defer CleanUpAll()
+
+	m := query("_acme-challenge.Example.com.", dns.TypeTXT)
+	if len(m.Answer) != 2 || m.Answer[0].(*dns.CNAME).Target != "abc123.acme.internal." || m.Answer[1].Header().Name != "abc123.acme.internal." {
+		t.Fatalf("Wrong delegated TXT answer: %v", m.Answer)
+	}
+
+	m = query("_acme-challenge.example.com.", dns.TypeCNAME)
+	if len(m.Answer) != 1 {
+		t.Errorf("Wrong CNAME answer: %v", m.Answer)
+	}
+}
+
+const testZone = `$ORIGIN example.net.
+$TTL 300
+@       IN SOA ns.example.net. hostmaster.example.net. 1 3600 600 86400 30
+@       IN NS  ns
+ns      IN A   192.0.2.53
+www     IN A   192.0.2.1
+        IN AAAA 2001:db8::1
+alias   IN CNAME www
+@       IN CAA 0 issue "pebble.letsencrypt.org"
+*.dyn   IN A   192.0.2.2
+sub     IN NS  ns.sub
+ns.sub  IN A   192.0.2.54
+`
+
+func TestZone(t *testing.T) {
+	zone, err := ParseZone(strings.NewReader(testZone), "", "test")
+	if err != nil {
+		t.Fatalf("ParseZone failed: %v", err)
+	}
+	zones = []*Zone{zone}
+	defer func() { zones = nil }()
+
+	m := query("alias.example.net.", dns.TypeAAAA)
+	if len(m.Answer) != 2 || m.Answer[1].Header().Rrtype != dns.TypeAAAA || m.Answer[1].Header().Ttl != 300 {
+		t.Errorf("Wrong CNAME chain answer: %v", m.Answer)
+	}
+
+	m = query("missing.example.net.", dns.TypeA)
+	if m.Rcode != dns.RcodeNameError || m.Ns[0].Header().Ttl != 30 {
+		t.Errorf("Expected NXDOMAIN with negative TTL: %v", m)
+	}
+
+	m = query("a.dyn.example.net.", dns.TypeA)
+	if len(m.Answer) != 1 || m.Answer[0].Header().Name != "a.dyn.example.net." {
+		t.Errorf("Wrong wildcard answer: %v", m.Answer)
+	}
+
+	// The parent of the wildcard is an empty non-terminal
+	m = query("dyn.example.net.", dns.TypeA)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 || len(m.Ns) != 1 {
+		t.Errorf("Expected NODATA for an empty non-terminal: %v", m)
+	}
+
+	m = query("host.sub.example.net.", dns.TypeA)
+	if m.Authoritative || len(m.Ns) != 1 || len(m.Extra) != 1 {
+		t.Errorf("Expected a referral: %v", m)
+	}
+
+	// An apex wildcard does not match empty non-terminals nor the names below them
+	entZone, err := ParseZone(strings.NewReader("$ORIGIN example.com.\n"+
+		"@ IN SOA ns.example.com. hostmaster.example.com. 1 3600 600 86400 30\n"+
+		"* IN A 192.0.2.9\n"+
+		"a.b IN A 192.0.2.10\n"), "", "test")
+	if err != nil {
+		t.Fatalf("ParseZone failed: %v", err)
+	}
+	zones = []*Zone{entZone}
+	if m = query("b.example.com.", dns.TypeA); m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Errorf("Expected NODATA for b.example.com.: %v", m)
+	}
+	if m = query("x.b.example.com.", dns.TypeA); m.Rcode != dns.RcodeNameError {
+		t.Errorf("Expected NXDOMAIN below an empty non-terminal: %v", m)
+	}
+	if m = query("c.example.com.", dns.TypeA); len(m.Answer) != 1 || m.Answer[0].Header().Name != "c.example.com." {
+		t.Errorf("Wrong apex wildcard answer: %v", m.Answer)
+	}
+	zones = []*Zone{zone}
+
+	path := filepath.Join(t.TempDir(), "example.org.zone")
+	_ = os.WriteFile(path, []byte("@ IN SOA ns.example.org. hostmaster.example.org. 1 3600 600 86400 60\nwww 120 IN MX 10 mail.example.org.\n"), 0644)
+	fileZone, err := LoadZone(path, "example.org")
+	if err != nil {
+		t.Fatalf("LoadZone failed: %v", err)
+	}
+	if mx := fileZone.records["www.example.org."][dns.TypeMX]; len(mx) != 1 || mx[0].Header().Ttl != 120 {
+		t.Errorf("Wrong zone file records: %v", fileZone.records)
+	}
+
+	if _, err := ParseZone(strings.NewReader("@ IN SOA ns. h. 1 1 1 1 1\n@ IN SRV 0 0 0 a."), "example.com.", "test"); err == nil {
+		t.Errorf("Unsupported record type accepted")
+	}
+}
+
+// recorder is a dns.ResponseWriter keeping the written message
+type recorder struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (r *recorder) RemoteAddr() net.Addr      { return &net.TCPAddr{} }
+func (r *recorder) WriteMsg(m *dns.Msg) error { r.msg = m; return nil }
+func (r *recorder) answer() *dns.Msg          { return r.msg }
+
+func TestDNSSEC(t *testing.T) {
+	for _, nsec3 := range []bool{false, true} {
+		signer, err := NewSigner("example.com", dns.ED25519, t.TempDir(), nsec3)
+		if err != nil {
+			t.Fatalf("NewSigner failed: %v", err)
+		}
+		signers = []*Signer{signer}
+		dnsARecord = net.ParseIP("1.2.3.4")
+		_ = Solver{}.Present(context.Background(), "www.example.com", "token", "keyauth")
+
+		exchange := func(name string, qtype uint16) *dns.Msg {
+			req := new(dns.Msg).SetQuestion(name, qtype)
+			req.SetEdns0(dns.DefaultMsgSize, true)
+			w := &recorder{}
+			handler(w, req)
+			return w.msg
+		}
+
+		// Every RRset of the answer must be signed by the ZSK
+		m := exchange("_acme-challenge.www.example.com.", dns.TypeTXT)
+		if len(m.Answer) != 2 {
+			t.Fatalf("Expected TXT and RRSIG: %v", m.Answer)
+		}
+		if err := m.Answer[1].(*dns.RRSIG).Verify(signer.zsk, m.Answer[:1]); err != nil {
+			t.Errorf("Invalid TXT signature: %v", err)
+		}
+
+		m = exchange("example.com.", dns.TypeDNSKEY)
+		if len(m.Answer) != 3 || m.Answer[2].(*dns.RRSIG).Verify(signer.ksk, m.Answer[:2]) != nil {
+			t.Errorf("Invalid DNSKEY answer: %v", m.Answer)
+		}
+
+		m = exchange("_acme-challenge.missing.example.com.", dns.TypeTXT)
+		denial := 0
+		for _, rr := range m.Ns {
+			if rr.Header().Rrtype == dns.TypeNSEC || rr.Header().Rrtype == dns.TypeNSEC3 {
+				denial++
+			}
+		}
+		if (nsec3 && (denial != 3 || m.Rcode != dns.RcodeNameError)) || (!nsec3 && (denial != 1 || m.Rcode != dns.RcodeSuccess)) {
+			t.Errorf("Wrong denial of existence (nsec3=%v): %v", nsec3, m)
+		}
+
+		CleanUpAll()
+	}
+	signers, dnsARecord = nil, nil
+}
+
+func TestQueryCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	if err := OpenCapture(path); err != nil {
+		t.Fatal(err)
+	}
+	handler(&recorder{}, new(dns.Msg).SetQuestion("_acme-challenge.missing.com.", dns.TypeTXT))
+	if err := CloseCapture(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []QueryRecord
+	err = ReadCapture(file, func(rec QueryRecord) error {
+		records = append(records, rec)
+		return nil
+	})
+	if err != nil || len(records) != 1 {
+		t.Fatalf("Wrong capture: %v %v", records, err)
+	}
+	if rec := records[0]; rec.Net != "tcp" || rec.Type != "TXT" || rec.Rcode != "NXDOMAIN" || new(dns.Msg).Unpack(rec.Response) != nil {
+		t.Errorf("Wrong captured record: %v", rec)
+	}
+}
+
+func TestSameAnswer(t *testing.T) {
+	signer, err := NewSigner("example.com", dns.ECDSAP256SHA256, t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signers = []*Signer{signer}
+	defer func() { signers = nil }()
+	_ = Solver{}.Present(context.Background(), "www.example.com", "token1", "keyauth1")
+	_ = Solver{}.Present(context.Background(), "www.example.com", "token2", "keyauth2")
+	defer CleanUpAll()
+
+	exchange := func() *dns.Msg {
+		req := new(dns.Msg).SetQuestion("_acme-challenge.www.example.com.", dns.TypeTXT)
+		req.SetEdns0(dns.DefaultMsgSize, true)
+		w := &recorder{}
+		handler(w, req)
+		return w.msg
+	}
+
+	// The signatures of a replayed answer differ, its records do not
+	captured, replayed := exchange(), exchange()
+	if len(captured.Answer) != 3 || captured.Answer[2].String() == replayed.Answer[2].String() {
+		t.Fatalf("Expected two TXT records and a new signature: %v %v", captured.Answer, replayed.Answer)
+	}
+	if !SameAnswer(captured, replayed) {
+		t.Errorf("Re-signed answer reported as different")
+	}
+
+	// Neither the order nor the TTL of the records matter
+	replayed.Answer[0], replayed.Answer[1] = replayed.Answer[1], replayed.Answer[0]
+	replayed.Answer[0].Header().Ttl++
+	if !SameAnswer(captured, replayed) {
+		t.Errorf("Reordered answer reported as different")
+	}
+
+	replayed.Answer[0].(*dns.TXT).Txt = []string{"other"}
+	if SameAnswer(captured, replayed) {
+		t.Errorf("Different record reported as same")
+	}
+	replayed = exchange()
+	replayed.Rcode = dns.RcodeServerFailure
+	if SameAnswer(captured, replayed) {
+		t.Errorf("Different rcode reported as same")
+	}
+}
+
+// udpRecorder is a recorder whose client queries over UDP
+type udpRecorder struct {
+	recorder
+}
+
+func (r *udpRecorder) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+}
+
+func TestTruncation(t *testing.T) {
+	var txt strings.Builder
+	txt.WriteString("$ORIGIN example.net.\n@ IN SOA ns.example.net. hostmaster.example.net. 1 3600 600 86400 30\n")
+	for i := 0; i < 40; i++ {
+		txt.WriteString("big IN TXT \"" + strings.Repeat(string(rune('a'+i%26)), 60) + "\"\n")
+	}
+	zone, err := ParseZone(strings.NewReader(txt.String()), "", "test")
+	if err != nil {
+		t.Fatalf("ParseZone failed: %v", err)
+	}
+	zones = []*Zone{zone}
+	defer func() { zones = nil }()
+
+	ask := func(w interface {
+		dns.ResponseWriter
+		answer() *dns.Msg
+	}, bufSize uint16) (*dns.Msg, int) {
+		r := new(dns.Msg).SetQuestion("big.example.net.", dns.TypeTXT)
+		if bufSize > 0 {
+			r.SetEdns0(bufSize, false)
+		}
+		handler(w, r)
+		packed, err := w.answer().Pack()
+		if err != nil {
+			t.Fatalf("Could not pack the answer: %v", err)
+		}
+		return w.answer(), len(packed)
+	}
+
+	// Without EDNS0 UDP answers fit in 512 bytes
+	m, size := ask(&udpRecorder{}, 0)
+	if !m.Truncated || size > dns.MinMsgSize || m.IsEdns0() != nil {
+		t.Errorf("Expected a truncated answer of at most 512 bytes: %v bytes, TC %v", size, m.Truncated)
+	}
+
+	// The EDNS0 buffer size of the client is honoured up to maxUDPSize
+	m, size = ask(&udpRecorder{}, 800)
+	if !m.Truncated || size > 800 || size <= dns.MinMsgSize {
+		t.Errorf("Expected a truncated answer of at most 800 bytes: %v bytes, TC %v", size, m.Truncated)
+	}
+	m, size = ask(&udpRecorder{}, 4096)
+	if !m.Truncated || size > maxUDPSize || m.IsEdns0().UDPSize() != maxUDPSize {
+		t.Errorf("Expected a truncated answer clamped to %v bytes: %v bytes, TC %v", maxUDPSize, size, m.Truncated)
+	}
+
+	// TCP answers are complete
+	m, _ = ask(&recorder{}, 0)
+	if m.Truncated || len(m.Answer) != 40 {
+		t.Errorf("Expected the complete answer over TCP: %v records, TC %v", len(m.Answer), m.Truncated)
+	}
+}
+
+func TestListeners(t *testing.T) {
+	// A listener that cannot bind is not kept for Shutdown
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	signer, err := NewSigner("acme.internal", dns.ED25519, t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{
+		ARecord:     net.ParseIP("192.0.2.1"),
+		Delegations: map[string]string{"example.com": "abc123.acme.internal"},
+		Signers:     []*Signer{signer},
+		Listeners: []Listener{
+			{Net: "udp", Addr: "127.0.0.1:0"},
+			{Net: "tcp", Addr: "127.0.0.1:0"},
+			{Net: "tcp", Addr: busy.Addr().String()},
+		},
+	}
+	Configure(cfg)
+	defer Configure(Config{})
+	done := make(chan struct{})
+	go func() {
+		DNS01(cfg)
+		close(done)
+	}()
+
+	// The solver publishes at the delegated name, signed, while the server starts
+	if err := (Solver{}).Present(context.Background(), "example.com", "token", "keyauth"); err != nil {
+		t.Fatal(err)
+	}
+	defer CleanUpAll()
+
+	var started []*dns.Server
+	for i := 0; i < 100 && len(started) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		serversMu.Lock()
+		started = append([]*dns.Server{}, Servers...)
+		serversMu.Unlock()
+	}
+	if len(started) != 2 {
+		t.Fatalf("Expected the 2 listeners that bound: %v", started)
+	}
+
+	for _, srv := range started {
+		var addr string
+		if srv.PacketConn != nil {
+			addr = srv.PacketConn.LocalAddr().String()
+		} else {
+			addr = srv.Listener.Addr().String()
+		}
+		r := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+		m, _, err := (&dns.Client{Net: srv.Net}).Exchange(r, addr)
+		if err != nil || len(m.Answer) != 1 {
+			t.Errorf("No answer over %v: %v %v", srv.Net, m, err)
+		}
+		r = new(dns.Msg).SetQuestion("abc123.acme.internal.", dns.TypeTXT)
+		r.SetEdns0(dns.DefaultMsgSize, true)
+		if m, _, err = (&dns.Client{Net: srv.Net}).Exchange(r, addr); err != nil || len(m.Answer) != 2 {
+			t.Errorf("No signed delegated TXT record over %v: %v %v", srv.Net, m, err)
+		}
+	}
+
+	if err := Shutdown(); err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("DNS01 did not return after Shutdown")
+	}
+}
@@ -0,0 +1,373 @@
+package dns01
+
+import (
+	"crypto"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/logger"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Flags of the DNSKEY records
+const (
+	flagZSK = dns.ZONE
+	flagKSK = dns.ZONE | dns.SEP
+)
+
+// Validity of the online signatures, the inception is backdated to tolerate clock skew
+const (
+	signatureInception  = -1 * time.Hour
+	signatureExpiration = 7 * 24 * time.Hour
+)
+
+// Algorithms maps the names accepted for the DNSSEC keys to their algorithm number
+var Algorithms = map[string]uint8{
+	"ecdsap256sha256": dns.ECDSAP256SHA256,
+	"ed25519":         dns.ED25519,
+}
+
+// signers sign the answers of their zone when the client sets the DO bit, set by Configure
+var signers []*Signer
+
+// Signer signs the answers of one zone online and proves the denial of existence with compact NSEC (RFC 9824) or
+// NSEC3 white lies (RFC 7129 appendix B).
+type Signer struct {
+	// Zone is the lower case fully qualified apex of the signed zone
+	Zone string
+	// NSEC3 selects NSEC3 instead of NSEC records for the denial of existence
+	NSEC3 bool
+
+	ksk, zsk       *dns.DNSKEY
+	kskKey, zskKey crypto.Signer
+}
+
+// NewSigner loads the KSK and ZSK of zone from the BIND key files (K<zone>+<alg>+<tag>.key/.private) in keyDir. Keys
+// missing from keyDir are generated and written there, together with the DS records of the KSK in dsset-<zone>.
+func NewSigner(zone string, algorithm uint8, keyDir string, nsec3 bool) (*Signer, error) {
+	s := &Signer{Zone: strings.ToLower(dns.Fqdn(zone)), NSEC3: nsec3}
+
+	if err := os.MkdirAll(keyDir, 0700); err != nil {
+		return nil, err
+	}
+
+	var err error
+	s.ksk, s.kskKey, err = loadOrGenerateKey(s.Zone, algorithm, flagKSK, keyDir)
+	if err != nil {
+		return nil, err
+	}
+	s.zsk, s.zskKey, err = loadOrGenerateKey(s.Zone, algorithm, flagZSK, keyDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var dsset strings.Builder
+	for _, ds := range s.DS() {
+		dsset.WriteString(ds.String() + "\n")
+		logger.Logger().Info().Msgf("DS record of %v: %v", s.Zone, ds)
+	}
+	if err := os.WriteFile(filepath.Join(keyDir, "dsset-"+s.Zone), []byte(dsset.String()), 0644); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// loadOrGenerateKey returns the key of zone with the algorithm and flags from keyDir, generating it if missing.
+func loadOrGenerateKey(zone string, algorithm uint8, flags uint16, keyDir string) (*dns.DNSKEY, crypto.Signer, error) {
+	files, err := filepath.Glob(filepath.Join(keyDir, fmt.Sprintf("K%s+%03d+*.key", zone, algorithm)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		rr, err := dns.NewRR(string(data))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%v: %w", file, err)
+		}
+		key, ok := rr.(*dns.DNSKEY)
+		if !ok || key.Flags != flags {
+			continue
+		}
+
+		privateFile := strings.TrimSuffix(file, ".key") + ".private"
+		private, err := os.Open(privateFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		priv, err := key.ReadPrivateKey(private, privateFile)
+		_ = private.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		signer, ok := priv.(crypto.Signer)
+		if !ok {
+			return nil, nil, errors.New(privateFile + " does not contain a signing key")
+		}
+		return key, signer, nil
+	}
+
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: algorithm,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	base := filepath.Join(keyDir, fmt.Sprintf("K%s+%03d+%05d", zone, algorithm, key.KeyTag()))
+	if err := os.WriteFile(base+".key", []byte(key.String()+"\n"), 0644); err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(base+".private", []byte(key.PrivateKeyString(priv)), 0600); err != nil {
+		return nil, nil, err
+	}
+	logger.Logger().Info().Msgf("Generated DNSSEC key %v", base)
+
+	return key, priv.(crypto.Signer), nil
+}
+
+// DS returns the DS records of the KSK, to publish in the parent zone.
+func (s *Signer) DS() []*dns.DS {
+	return []*dns.DS{s.ksk.ToDS(dns.SHA256)}
+}
+
+// signerFor returns the signer of the zone containing name, or nil.
+func signerFor(name string) *Signer {
+	var best *Signer
+	for _, s := range signers {
+		if dns.IsSubDomain(s.Zone, name) && (best == nil || dns.CountLabel(s.Zone) > dns.CountLabel(best.Zone)) {
+			best = s
+		}
+	}
+	return best
+}
+
+// answerApex answers the DNSSEC specific queries at the apex of the zone, it reports whether q was answered.
+func (s *Signer) answerApex(m *dns.Msg, q dns.Question) bool {
+	if strings.ToLower(q.Name) != s.Zone {
+		return false
+	}
+
+	switch q.Qtype {
+	case dns.TypeSOA:
+		// The SOA of a signed zone without zone file is synthesized
+		if zoneFor(zones, s.Zone) != nil {
+			return false
+		}
+		m.Answer = append(m.Answer, soaFor(s.Zone))
+	case dns.TypeDNSKEY:
+		m.Answer = append(m.Answer, s.ksk, s.zsk)
+	case dns.TypeNSEC3PARAM:
+		if !s.NSEC3 {
+			return false
+		}
+		m.Answer = append(m.Answer, &dns.NSEC3PARAM{
+			Hdr:  dns.RR_Header{Name: s.Zone, Rrtype: dns.TypeNSEC3PARAM, Class: dns.ClassINET, Ttl: 0},
+			Hash: dns.SHA1,
+		})
+	default:
+		return false
+	}
+	return true
+}
+
+// types returns the types present at name, including the DNSSEC ones added by the signer.
+func (s *Signer) types(name string) []uint16 {
+	types := append(typesAt(name), dns.TypeRRSIG)
+	if name == s.Zone {
+		types = append(types, dns.TypeDNSKEY)
+		if s.NSEC3 {
+			types = append(types, dns.TypeNSEC3PARAM)
+		}
+	}
+	if !s.NSEC3 {
+		types = append(types, dns.TypeNSEC)
+	}
+	slices.Sort(types)
+	return slices.Compact(types)
+}
+
+// sign adds the denial of existence records and the RRSIG records to the answer m of q.
+func (s *Signer) sign(m *dns.Msg, q dns.Question) {
+	name := strings.ToLower(q.Name)
+
+	switch {
+	case m.Rcode == dns.RcodeNameError:
+		m.Ns = append(m.Ns, s.nxdomain(name)...)
+		// RFC 9824 section 3.2, the compact denial turns NXDOMAIN into NODATA with the NXNAME type
+		if !s.NSEC3 {
+			m.Rcode = dns.RcodeSuccess
+		}
+	case m.Rcode == dns.RcodeSuccess && len(m.Answer) == 0 && !isReferral(m):
+		m.Ns = append(m.Ns, s.nodata(name))
+	case isReferral(m):
+		// Prove that the delegation is insecure (no DS record)
+		m.Ns = append(m.Ns, s.nodata(strings.ToLower(m.Ns[0].Header().Name)))
+	}
+
+	m.Answer = s.signSection(m.Answer)
+	if isReferral(m) {
+		// The NS records of a delegation are not authoritative and stay unsigned
+		m.Ns = append(m.Ns[:1:1], s.signSection(m.Ns[1:])...)
+	} else {
+		m.Ns = s.signSection(m.Ns)
+	}
+}
+
+// isReferral reports whether m is a referral to a delegated zone.
+func isReferral(m *dns.Msg) bool {
+	return !m.Authoritative && len(m.Ns) > 0 && m.Ns[0].Header().Rrtype == dns.TypeNS
+}
+
+// signSection returns the records of a section followed by the RRSIG of each of their RRsets.
+func (s *Signer) signSection(rrs []dns.RR) []dns.RR {
+	type rrsetKey struct {
+		name  string
+		rtype uint16
+	}
+
+	var keys []rrsetKey
+	rrsets := make(map[rrsetKey][]dns.RR)
+	for _, rr := range rrs {
+		k := rrsetKey{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}
+		if k.rtype == dns.TypeRRSIG || !dns.IsSubDomain(s.Zone, k.name) {
+			continue
+		}
+		if _, ok := rrsets[k]; !ok {
+			keys = append(keys, k)
+		}
+		rrsets[k] = append(rrsets[k], rr)
+	}
+
+	out := slices.Clone(rrs)
+	for _, k := range keys {
+		key, priv := s.zsk, s.zskKey
+		if k.rtype == dns.TypeDNSKEY {
+			key, priv = s.ksk, s.kskKey
+		}
+
+		rrset := rrsets[k]
+		now := time.Now()
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrset[0].Header().Ttl},
+			Algorithm:  key.Algorithm,
+			OrigTtl:    rrset[0].Header().Ttl,
+			Inception:  uint32(now.Add(signatureInception).Unix()),
+			Expiration: uint32(now.Add(signatureExpiration).Unix()),
+			KeyTag:     key.KeyTag(),
+			SignerName: s.Zone,
+		}
+		if err := sig.Sign(priv, rrset); err != nil {
+			logger.Logger().Error().Msgf("Could not sign %v %v: %v", k.name, dns.TypeToString[k.rtype], err)
+			continue
+		}
+		out = append(out, sig)
+	}
+
+	return out
+}
+
+// negativeTTL returns the TTL of the denial of existence records (RFC 4034 section 4 and RFC 5155 section 3).
+func (s *Signer) negativeTTL() uint32 {
+	soa := soaFor(s.Zone)
+	if z := zoneFor(zones, s.Zone); z != nil && z.Origin == s.Zone {
+		soa = z.SOA()
+	}
+	return min(soa.Hdr.Ttl, soa.Minttl)
+}
+
+// nodata returns the record proving that name exists but only with the types present there.
+func (s *Signer) nodata(name string) dns.RR {
+	if s.NSEC3 {
+		hash := hashName(name)
+		return s.nsec3(hash, s.types(name), shiftHash(hash, 1))
+	}
+	return s.compactNSEC(name, s.types(name))
+}
+
+// nxdomain returns the records proving that name does not exist.
+func (s *Signer) nxdomain(name string) []dns.RR {
+	if !s.NSEC3 {
+		return []dns.RR{s.compactNSEC(name, []uint16{dns.TypeNSEC, dns.TypeRRSIG, dns.TypeNXNAME})}
+	}
+
+	// Closest encloser proof of RFC 5155 section 7.2.1: the closest encloser exists, the next closer name and the
+	// wildcard at the closest encloser do not
+	nextCloser := name
+	closestEncloser := name
+	for {
+		i, end := dns.NextLabel(closestEncloser, 0)
+		if end || !dns.IsSubDomain(s.Zone, closestEncloser[i:]) {
+			break
+		}
+		nextCloser, closestEncloser = closestEncloser, closestEncloser[i:]
+		if closestEncloser == s.Zone || nameExists(closestEncloser) {
+			break
+		}
+	}
+
+	hash := hashName(closestEncloser)
+	records := []dns.RR{s.nsec3(hash, s.types(closestEncloser), shiftHash(hash, 1))}
+	for _, covered := range []string{nextCloser, "*." + closestEncloser} {
+		hash := hashName(covered)
+		records = append(records, s.nsec3(shiftHash(hash, -1), nil, shiftHash(hash, 1)))
+	}
+	return records
+}
+
+// compactNSEC returns the NSEC record of name covering only name itself (RFC 9824).
+func (s *Signer) compactNSEC(name string, types []uint16) dns.RR {
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: s.negativeTTL()},
+		NextDomain: "\\000." + name,
+		TypeBitMap: types,
+	}
+}
+
+// nsec3 returns the NSEC3 record from ownerHash to nextHash with the types.
+func (s *Signer) nsec3(ownerHash string, types []uint16, nextHash string) dns.RR {
+	return &dns.NSEC3{
+		Hdr:        dns.RR_Header{Name: strings.ToLower(ownerHash) + "." + s.Zone, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: s.negativeTTL()},
+		Hash:       dns.SHA1,
+		Iterations: 0,
+		SaltLength: 0,
+		HashLength: 20,
+		NextDomain: nextHash,
+		TypeBitMap: types,
+	}
+}
+
+// hashName returns the NSEC3 hash of name without salt nor additional iterations (RFC 9276).
+func hashName(name string) string {
+	return dns.HashName(name, dns.SHA1, 0, "")
+}
+
+// shiftHash adds delta (±1) to a base32hex encoded NSEC3 hash, wrapping around.
+func shiftHash(hash string, delta int) string {
+	raw, err := base32.HexEncoding.DecodeString(strings.ToUpper(hash))
+	if err != nil {
+		return hash
+	}
+	for i := len(raw) - 1; i >= 0; i-- {
+		old := raw[i]
+		raw[i] = byte(int(raw[i]) + delta)
+		if (delta > 0 && old != 0xff) || (delta < 0 && old != 0x00) {
+			break
+		}
+	}
+	return base32.HexEncoding.EncodeToString(raw)
+}
@@ -0,0 +1,154 @@
+package dns01
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/logger"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// QueryRecord is one query received by the DNS server and the answer it sent, as written to the capture file.
+type QueryRecord struct {
+	Time time.Time `json:"time"`
+	// Net is either udp or tcp
+	Net string `json:"net"`
+	// Source is the host:port of the client
+	Source string `json:"source"`
+	Name   string `json:"qname"`
+	Type   string `json:"qtype"`
+	Rcode  string `json:"rcode"`
+	// Answers is the number of records of the answer section
+	Answers   int  `json:"answers"`
+	Truncated bool `json:"truncated"`
+	// Query and Response are the messages in wire format, base64 encoded in JSON
+	Query    []byte `json:"query"`
+	Response []byte `json:"response"`
+}
+
+// String formats the record as a log line.
+func (rec QueryRecord) String() string {
+	truncated := ""
+	if rec.Truncated {
+		truncated = ", truncated"
+	}
+	return fmt.Sprintf("%v %v %v %v -> %v, %v answers%v", rec.Net, rec.Source, rec.Name, rec.Type, rec.Rcode, rec.Answers, truncated)
+}
+
+// capture JSON-lines file receiving every QueryRecord, none when nil
+var capture struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// OpenCapture appends a QueryRecord for every query to the JSON-lines file at path.
+func OpenCapture(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	if capture.file != nil {
+		capture.file.Close()
+	}
+	capture.file, capture.enc = file, json.NewEncoder(file)
+	return nil
+}
+
+// CloseCapture stops writing the capture file.
+func CloseCapture() error {
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	if capture.file == nil {
+		return nil
+	}
+	err := capture.file.Close()
+	capture.file, capture.enc = nil, nil
+	return err
+}
+
+// logQuery logs the query r received through w and its answer m, and writes them to the capture file.
+func logQuery(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg) {
+	rec := QueryRecord{
+		Time:      time.Now().UTC(),
+		Net:       "tcp",
+		Source:    w.RemoteAddr().String(),
+		Rcode:     dns.RcodeToString[m.Rcode],
+		Answers:   len(m.Answer),
+		Truncated: m.Truncated,
+	}
+	if _, isUDP := w.RemoteAddr().(*net.UDPAddr); isUDP {
+		rec.Net = "udp"
+	}
+	if len(r.Question) > 0 {
+		rec.Name, rec.Type = r.Question[0].Name, dns.TypeToString[r.Question[0].Qtype]
+	}
+	logger.Logger().Info().Msgf("DNS query %v", rec)
+
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	if capture.enc == nil {
+		return
+	}
+
+	var err error
+	if rec.Query, err = r.Pack(); err == nil {
+		rec.Response, err = m.Pack()
+	}
+	if err == nil {
+		err = capture.enc.Encode(rec)
+	}
+	if err != nil {
+		logger.Logger().Error().Msgf("Error while capturing DNS query: %v", err)
+	}
+}
+
+// ReadCapture calls fn with every QueryRecord of the capture r, in order, until fn returns an error.
+func ReadCapture(r io.Reader, fn func(QueryRecord) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 4*dns.MaxMsgSize)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec QueryRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("line %v: %w", line, err)
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// SameAnswer tells whether the answers a and b have the same rcode and the same records, whatever their order and TTL.
+// RRSIGs are left out: the online signer generates new signatures for every answer.
+func SameAnswer(a *dns.Msg, b *dns.Msg) bool {
+	return a.Rcode == b.Rcode && slices.Equal(answerData(a.Answer), answerData(b.Answer))
+}
+
+// answerData returns the records of rrs but the RRSIGs in presentation format without TTL, sorted.
+func answerData(rrs []dns.RR) []string {
+	var lines []string
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			continue
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		lines = append(lines, rr.String())
+	}
+	slices.Sort(lines)
+	return lines
+}
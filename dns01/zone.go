@@ -0,0 +1,271 @@
+package dns01
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// supportedTypes record types accepted in zone files
+var supportedTypes = map[uint16]bool{
+	dns.TypeA:     true,
+	dns.TypeAAAA:  true,
+	dns.TypeCNAME: true,
+	dns.TypeMX:    true,
+	dns.TypeNS:    true,
+	dns.TypeSOA:   true,
+	dns.TypeCAA:   true,
+	dns.TypeTXT:   true,
+}
+
+// defaultZoneTTL TTL of the zone records without explicit TTL and $TTL directive
+const defaultZoneTTL = 3600
+
+// Zone is a set of records served authoritatively by the DNS server.
+type Zone struct {
+	// Origin is the lower case fully qualified apex of the zone
+	Origin string
+	// records maps the lower case owner names to their RRsets, keyed by type
+	records map[string]map[uint16][]dns.RR
+}
+
+// LoadZone reads an RFC 1035 zone file from path. When origin is empty, it is taken from the $ORIGIN or the SOA record
+// of the file.
+func LoadZone(path string, origin string) (*Zone, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseZone(f, origin, path)
+}
+
+// ParseZone parses an RFC 1035 zone file. file is only used in error messages.
+func ParseZone(r io.Reader, origin string, file string) (*Zone, error) {
+	zp := dns.NewZoneParser(r, dns.Fqdn(origin), file)
+	zp.SetDefaultTTL(defaultZoneTTL)
+
+	var rrs []dns.RR
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+
+	return newZone(origin, rrs)
+}
+
+// newZone builds a Zone from its records. The zone must contain exactly one SOA record, at its apex.
+func newZone(origin string, rrs []dns.RR) (*Zone, error) {
+	z := &Zone{records: make(map[string]map[uint16][]dns.RR)}
+
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if !supportedTypes[hdr.Rrtype] {
+			return nil, fmt.Errorf("unsupported record type %v for %v", dns.TypeToString[hdr.Rrtype], hdr.Name)
+		}
+		if hdr.Rrtype == dns.TypeSOA {
+			if z.Origin != "" {
+				return nil, fmt.Errorf("zone %v has more than one SOA record", z.Origin)
+			}
+			z.Origin = strings.ToLower(hdr.Name)
+		}
+	}
+
+	if z.Origin == "" {
+		return nil, errors.New("zone without SOA record")
+	}
+	if origin != "" && !strings.EqualFold(dns.Fqdn(origin), z.Origin) {
+		return nil, fmt.Errorf("SOA record owner %v does not match the origin %v", z.Origin, origin)
+	}
+
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		name := strings.ToLower(hdr.Name)
+		if !dns.IsSubDomain(z.Origin, name) {
+			return nil, fmt.Errorf("record %v is outside of zone %v", hdr.Name, z.Origin)
+		}
+		if z.records[name] == nil {
+			z.records[name] = make(map[uint16][]dns.RR)
+		}
+		z.records[name][hdr.Rrtype] = append(z.records[name][hdr.Rrtype], rr)
+	}
+
+	// RFC 1034 section 3.6.2, a CNAME cannot coexist with other data
+	for name, rrsets := range z.records {
+		if _, ok := rrsets[dns.TypeCNAME]; ok && len(rrsets) > 1 {
+			return nil, fmt.Errorf("CNAME at %v coexists with other records", name)
+		}
+	}
+
+	return z, nil
+}
+
+// SOA returns the SOA record of the zone.
+func (z *Zone) SOA() *dns.SOA {
+	return z.records[z.Origin][dns.TypeSOA][0].(*dns.SOA)
+}
+
+// negativeSOA returns the SOA record to put in the authority section of negative answers, its TTL is the negative
+// caching TTL of RFC 2308 section 5.
+func (z *Zone) negativeSOA() dns.RR {
+	soa := dns.Copy(z.SOA()).(*dns.SOA)
+	soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+	return soa
+}
+
+// delegation returns the NS records of the closest zone cut between name and the apex, if any.
+func (z *Zone) delegation(name string) []dns.RR {
+	labels := dns.Split(name)
+	for _, i := range labels {
+		owner := name[i:]
+		if owner == z.Origin {
+			return nil
+		}
+		if ns, ok := z.records[owner][dns.TypeNS]; ok {
+			return ns
+		}
+	}
+	return nil
+}
+
+// wildcard returns the records of the wildcard matching name, following the closest encloser rule of RFC 4592:
+// existing names, empty non-terminals included, are never matched.
+func (z *Zone) wildcard(name string) map[uint16][]dns.RR {
+	if z.hasName(name) {
+		return nil
+	}
+	labels := dns.Split(name)
+	for _, i := range labels[1:] {
+		encloser := name[i:]
+		if rrsets, ok := z.records["*."+encloser]; ok {
+			return rrsets
+		}
+		if z.hasName(encloser) || encloser == z.Origin {
+			return nil
+		}
+	}
+	return nil
+}
+
+// resolve fills m with the authoritative answer for q, which must be inside the zone.
+func (z *Zone) resolve(m *dns.Msg, q dns.Question, servers []*Zone) {
+	name := strings.ToLower(q.Name)
+
+	// CNAME chains are followed within the served zones, bounded to avoid loops
+	for hops := 0; hops < 8; hops++ {
+		if ns := z.delegation(name); ns != nil {
+			m.Authoritative = false
+			m.Ns = append(m.Ns, ns...)
+			m.Extra = append(m.Extra, z.glue(ns)...)
+			return
+		}
+
+		// An empty non-terminal exists without records, its answers are NODATA
+		if !z.exists(name) {
+			// Only the first name of the chain decides the rcode (RFC 6604)
+			if len(m.Answer) == 0 {
+				m.Rcode = dns.RcodeNameError
+			}
+			m.Ns = append(m.Ns, z.negativeSOA())
+			return
+		}
+
+		rrsets, ok := z.records[name]
+		if !ok {
+			if rrsets = z.wildcard(name); rrsets != nil {
+				rrsets = synthesize(rrsets, name)
+			}
+		}
+		if rrs, ok := rrsets[q.Qtype]; ok {
+			m.Answer = append(m.Answer, rrs...)
+			return
+		}
+
+		cname, ok := rrsets[dns.TypeCNAME]
+		if !ok || q.Qtype == dns.TypeCNAME {
+			m.Ns = append(m.Ns, z.negativeSOA())
+			return
+		}
+		m.Answer = append(m.Answer, cname...)
+
+		name = strings.ToLower(cname[0].(*dns.CNAME).Target)
+		if next := zoneFor(servers, name); next != nil {
+			z = next
+		} else {
+			// The target is not ours, the resolver continues the chain
+			return
+		}
+	}
+}
+
+// exists reports whether name exists in the zone, including empty non-terminals and wildcard matches.
+func (z *Zone) exists(name string) bool {
+	return z.hasName(name) || z.wildcard(name) != nil
+}
+
+// hasName reports whether name owns records or is an empty non-terminal, wildcards excepted.
+func (z *Zone) hasName(name string) bool {
+	if _, ok := z.records[name]; ok {
+		return true
+	}
+	for owner := range z.records {
+		if dns.IsSubDomain(name, owner) {
+			return true
+		}
+	}
+	return false
+}
+
+// types returns the types of the records at name.
+func (z *Zone) types(name string) []uint16 {
+	rrsets, ok := z.records[name]
+	if !ok {
+		rrsets = z.wildcard(name)
+	}
+	var types []uint16
+	for rrtype := range rrsets {
+		types = append(types, rrtype)
+	}
+	return types
+}
+
+// glue returns the address records of the name servers of ns that are inside the zone.
+func (z *Zone) glue(ns []dns.RR) []dns.RR {
+	var glue []dns.RR
+	for _, rr := range ns {
+		target := strings.ToLower(rr.(*dns.NS).Ns)
+		glue = append(glue, z.records[target][dns.TypeA]...)
+		glue = append(glue, z.records[target][dns.TypeAAAA]...)
+	}
+	return glue
+}
+
+// synthesize copies the wildcard RRsets with name as owner.
+func synthesize(rrsets map[uint16][]dns.RR, name string) map[uint16][]dns.RR {
+	out := make(map[uint16][]dns.RR, len(rrsets))
+	for rrtype, rrs := range rrsets {
+		for _, rr := range rrs {
+			cp := dns.Copy(rr)
+			cp.Header().Name = name
+			out[rrtype] = append(out[rrtype], cp)
+		}
+	}
+	return out
+}
+
+// zoneFor returns the zone with the longest origin containing name, or nil.
+func zoneFor(zones []*Zone, name string) *Zone {
+	var best *Zone
+	for _, z := range zones {
+		if dns.IsSubDomain(z.Origin, name) && (best == nil || dns.CountLabel(z.Origin) > dns.CountLabel(best.Origin)) {
+			best = z
+		}
+	}
+	return best
+}
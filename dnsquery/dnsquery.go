@@ -0,0 +1,76 @@
+package dnsquery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// MaxCNAMEs bounds the CNAME chains followed by Follow
+const MaxCNAMEs = 8
+
+// Exchange sends a query of name and qtype to server, recursive or not. Answers other than NOERROR and NXDOMAIN are
+// errors: a server failure must not be mistaken for an empty answer.
+func Exchange(ctx context.Context, client *dns.Client, server string, name string, qtype uint16, recursive bool) (*dns.Msg, error) {
+	msg := new(dns.Msg).SetQuestion(dns.Fqdn(name), qtype)
+	msg.RecursionDesired = recursive
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+
+	res, _, err := client.ExchangeContext(ctx, msg, server)
+	if err != nil {
+		return nil, err
+	}
+	if res.Rcode != dns.RcodeSuccess && res.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("query of %v %v failed: %v", name, dns.TypeToString[qtype], dns.RcodeToString[res.Rcode])
+	}
+	return res, nil
+}
+
+// Answer returns the records of qtype answering name in res, following the CNAME chain of the answer section. It also
+// returns the last name of the chain, name itself without CNAME, or an empty name when the chain loops.
+func Answer(res *dns.Msg, name string, qtype uint16) ([]dns.RR, string) {
+	for hops := 0; hops < MaxCNAMEs; hops++ {
+		var records []dns.RR
+		target := ""
+		for _, rr := range res.Answer {
+			if !strings.EqualFold(rr.Header().Name, name) {
+				continue
+			}
+			if rr.Header().Rrtype == qtype {
+				records = append(records, rr)
+			} else if cname, ok := rr.(*dns.CNAME); ok {
+				target = cname.Target
+			}
+		}
+		if len(records) > 0 || target == "" {
+			return records, name
+		}
+		name = target
+	}
+	return nil, ""
+}
+
+// Follow resolves name and qtype with the recursive resolver at server, querying the CNAME targets the resolver did
+// not follow itself. It returns the records of qtype and the name they belong to, the end of the CNAME chain; no
+// records means that the name has none.
+func Follow(ctx context.Context, client *dns.Client, server string, name string, qtype uint16) ([]dns.RR, string, error) {
+	name = dns.Fqdn(name)
+	for hops := 0; hops < MaxCNAMEs; hops++ {
+		res, err := Exchange(ctx, client, server, name, qtype, true)
+		if err != nil {
+			return nil, "", err
+		}
+		records, target := Answer(res, name, qtype)
+		if target == "" {
+			break
+		}
+		if len(records) > 0 || strings.EqualFold(target, name) {
+			return records, target, nil
+		}
+		name = target
+	}
+	return nil, "", errors.New("too many CNAMEs while following " + name)
+}
@@ -0,0 +1,88 @@
+package dnsquery
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// startResolver serves the CNAMEs of cnames one hop at a time, like a resolver that does not follow them, and the TXT
+// record of the names of txt. SERVFAIL is answered for fail.example.com.
+func startResolver(t *testing.T, cnames map[string]string, txt map[string]string) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg).SetReply(r)
+		q := r.Question[0]
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}
+		switch {
+		case q.Name == "fail.example.com.":
+			m.Rcode = dns.RcodeServerFailure
+		case cnames[q.Name] != "":
+			m.Answer = append(m.Answer, &dns.CNAME{Hdr: hdr, Target: cnames[q.Name]})
+		case txt[q.Name] != "":
+			hdr.Rrtype = dns.TypeTXT
+			m.Answer = append(m.Answer, &dns.TXT{Hdr: hdr, Txt: []string{txt[q.Name]}})
+		}
+		_ = w.WriteMsg(m)
+	})
+
+	server := &dns.Server{PacketConn: pc, Handler: handler}
+	go func() { _ = server.ActivateAndServe() }()
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestFollow(t *testing.T) {
+	addr := startResolver(t,
+		map[string]string{"a.example.com.": "b.example.com.", "b.example.com.": "c.example.com.",
+			"loop1.example.com.": "loop2.example.com.", "loop2.example.com.": "loop1.example.com."},
+		map[string]string{"c.example.com.": "value", "d.example.com.": "other"})
+	ctx := context.Background()
+
+	for _, test := range []struct {
+		name   string
+		target string
+		values int
+	}{
+		{"a.example.com", "c.example.com.", 1},
+		{"d.example.com.", "d.example.com.", 1},
+		{"none.example.com.", "none.example.com.", 0},
+	} {
+		records, target, err := Follow(ctx, new(dns.Client), addr, test.name, dns.TypeTXT)
+		if err != nil || target != test.target || len(records) != test.values {
+			t.Errorf("Follow(%v) = %v %v %v", test.name, records, target, err)
+		}
+	}
+
+	if _, _, err := Follow(ctx, new(dns.Client), addr, "loop1.example.com.", dns.TypeTXT); err == nil {
+		t.Error("CNAME loop followed")
+	}
+	if _, _, err := Follow(ctx, new(dns.Client), addr, "fail.example.com.", dns.TypeTXT); err == nil {
+		t.Error("SERVFAIL accepted")
+	}
+}
+
+func TestAnswer(t *testing.T) {
+	cname := func(name, target string) dns.RR {
+		return &dns.CNAME{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET}, Target: target}
+	}
+	res := new(dns.Msg)
+	res.Answer = []dns.RR{
+		cname("A.example.com.", "b.example.com."),
+		&dns.TXT{Hdr: dns.RR_Header{Name: "b.example.com.", Rrtype: dns.TypeTXT, Class: dns.ClassINET}, Txt: []string{"v"}},
+	}
+	if records, name := Answer(res, "a.example.com.", dns.TypeTXT); len(records) != 1 || name != "b.example.com." {
+		t.Errorf("Wrong answer: %v %v", records, name)
+	}
+
+	res.Answer = []dns.RR{cname("a.example.com.", "b.example.com."), cname("b.example.com.", "a.example.com.")}
+	if records, name := Answer(res, "a.example.com.", dns.TypeTXT); len(records) != 0 || name != "" {
+		t.Errorf("Loop not detected: %v %v", records, name)
+	}
+}
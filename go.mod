@@ -2,11 +2,14 @@ module gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme
 
 go 1.22
 
+require (
+	github.com/miekg/dns v1.1.62
+	github.com/rs/zerolog v1.33.0
+)
+
 require (
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
-	github.com/miekg/dns v1.1.62 // indirect
-	github.com/rs/zerolog v1.33.0 // indirect
 	golang.org/x/mod v0.18.0 // indirect
 	golang.org/x/net v0.27.0 // indirect
 	golang.org/x/sync v0.7.0 // indirect
@@ -1,64 +1,200 @@
 package http01
 
 import (
+	"context"
 	"errors"
 	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/logger"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/solver"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
 // Server store the server object. Used to shut down from outside context.
 var Server *http.Server
 
-// tokensList contains a list of tokens served on the HTTP server used for validation of ACME protocol
-var tokensList []string
+// tokens key authorizations served on the HTTP server used for validation of ACME protocol, keyed by domain and token
+// and looked up by token
+var tokens = solver.NewTokenStore()
 
-// mu Mutex to protect access to the list
-var mu sync.RWMutex
+// expiryCheckInterval how often expired tokens are removed
+const expiryCheckInterval = 1 * time.Minute
+
+// challengePath prefix of the paths serving the key authorizations (RFC 8555 section 8.3)
+const challengePath = "/.well-known/acme-challenge/"
+
+// strictHost only serves the key authorization of a token to requests for the identifier it was presented for
+var strictHost bool
+
+// DefaultListen address of the http01 server, as expected by the CI
+const DefaultListen = "0.0.0.0:5002"
+
+// fallback handles the requests outside of challengePath, they get a 404 when nil
+var fallback http.Handler
 
 func handler(w http.ResponseWriter, r *http.Request) {
-	mu.RLock()
-	defer mu.RUnlock()
-
-	// Provide a valid HTTP path for each challenge token
-	for _, token := range tokensList {
-		if r.URL.Path == "/.well-known/acme-challenge/"+strings.Split(token, ".")[0] {
-			w.Header().Set("Content-Type", "text/plain")
-			w.WriteHeader(http.StatusOK)
-			_, err := io.WriteString(w, token)
-			if err != nil {
-				logger.Logger().Error().Msgf("Error while writing HTTP answer: %v", err)
-			}
-			return
+	token, found := strings.CutPrefix(r.URL.Path, challengePath)
+	if !found && fallback != nil {
+		fallback.ServeHTTP(w, r)
+		return
+	}
+	if !found || !solver.ValidToken(token) {
+		logger.Logger().Debug().Msgf("No challenge at %v %v from %v", r.Host, r.URL.Path, r.RemoteAddr)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	t, found := lookup(token, r.Host)
+	if !found {
+		logger.Logger().Info().Msgf("No key authorization for token %v (host %v) requested by %v", token, r.Host, r.RemoteAddr)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Length", strconv.Itoa(len(t.Value)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, err := io.WriteString(w, t.Value)
+	if err != nil {
+		logger.Logger().Error().Msgf("Error while writing HTTP answer: %v", err)
+	}
+}
+
+// lookup returns the key authorization of token for a request to host. Unless strictHost is set, the token of any
+// identifier is served.
+func lookup(token string, host string) (solver.Token, bool) {
+	candidates := tokens.Token(token)
+	if !strictHost {
+		if len(candidates) == 0 {
+			return solver.Token{}, false
+		}
+		return candidates[0], true
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(host, ".")
+	for _, t := range candidates {
+		if strings.EqualFold(t.Domain, host) {
+			return t, true
 		}
 	}
+	return solver.Token{}, false
+}
+
+// Solver answers http-01 challenges by serving the key authorizations on the HTTP server.
+type Solver struct{}
+
+// Present serves keyAuth under the well-known path of its token. The path is removed by CleanUp, or once the deadline
+// of ctx is over.
+func (Solver) Present(ctx context.Context, domain, token, keyAuth string) error {
+	tokens.Add(solver.Token{
+		Domain:  domain,
+		Token:   token,
+		Value:   keyAuth,
+		Expires: solver.ExpiryFromContext(ctx),
+	})
+	logger.Logger().Debug().Msgf("Token added for %v: %v", domain, token)
+	return nil
+}
+
+// CleanUp stops serving the key authorization of the token.
+func (Solver) CleanUp(_ context.Context, domain, token, _ string) error {
+	if tokens.Remove(domain, token) {
+		logger.Logger().Debug().Msgf("Token removed for %v: %v", domain, token)
+	}
+	return nil
+}
+
+// CleanUpAll stops serving every key authorization, used when the server stops.
+func CleanUpAll() {
+	for _, t := range tokens.RemoveAll() {
+		logger.Logger().Debug().Msgf("Token removed for %v: %v", t.Domain, t.Token)
+	}
+}
 
-	// In case it is not handling any token
-	w.WriteHeader(http.StatusNotFound)
+// Config configures the http01 server.
+type Config struct {
+	// Listen is the host:port of the server, DefaultListen when empty
+	Listen string
+	// StrictHost only serves a key authorization when the Host of the request is the identifier of the challenge
+	StrictHost bool
+	// Upstream receives the requests outside of the challenge paths, so that the server can sit in front of an
+	// existing site
+	Upstream *url.URL
+	// RedirectHTTPS redirects the requests outside of the challenge paths to HTTPS, unless Upstream is set
+	RedirectHTTPS bool
 }
 
-func HTTP01(tokenChannel <-chan string) {
+// newProxy returns a reverse proxy to upstream keeping the Host of the requests.
+func newProxy(upstream *url.URL) http.Handler {
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(upstream)
+			r.SetXForwarded()
+			r.Out.Host = r.In.Host
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.Logger().Error().Msgf("Error while proxying %v %v to %v: %v", r.Method, r.URL.Path, upstream, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+}
+
+// redirectHTTPS redirects the request to the same URL over HTTPS on the default port.
+func redirectHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+	}
+	target := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+	http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+}
+
+func HTTP01(cfg Config) {
+	strictHost = cfg.StrictHost
+	switch {
+	case cfg.Upstream != nil:
+		fallback = newProxy(cfg.Upstream)
+	case cfg.RedirectHTTPS:
+		fallback = http.HandlerFunc(redirectHTTPS)
+	}
+
+	addr := cfg.Listen
+	if addr == "" {
+		addr = DefaultListen
+	}
 
+	// Remove the tokens of authorizations that expired without being cleaned up
 	go func() {
-		for {
-			select {
-			case s := <-tokenChannel: // Receive tokens as normal
-				mu.Lock()
-				tokensList = append(tokensList, s)
-				logger.Logger().Debug().Msgf("Token added: ", s)
-				mu.Unlock()
-			case <-time.After(100 * time.Millisecond): // When done is closed, exit the loop
-				continue
+		for now := range time.Tick(expiryCheckInterval) {
+			for _, t := range tokens.RemoveExpired(now) {
+				logger.Logger().Debug().Msgf("Token expired for %v: %v", t.Domain, t.Token)
 			}
 		}
 	}()
 
 	// Setup HTTP Server according to ACME Protocol
 	Server = &http.Server{
-		Addr:    "0.0.0.0:5002",
+		Addr:    addr,
 		Handler: http.HandlerFunc(handler),
 	}
 
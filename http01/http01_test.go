@@ -0,0 +1,95 @@
+package http01
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func get(method string, host string, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Host = host
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func TestHandler(t *testing.T) {
+	_ = Solver{}.Present(context.Background(), "example.com", "tok_en-1", "tok_en-1.thumb")
+	defer CleanUpAll()
+
+	rec := get(http.MethodGet, "other.org", "/.well-known/acme-challenge/tok_en-1")
+	if rec.Code != http.StatusOK || rec.Body.String() != "tok_en-1.thumb" || rec.Header().Get("Content-Length") != "14" {
+		t.Errorf("Wrong answer: %v %q %v", rec.Code, rec.Body, rec.Header())
+	}
+
+	rec = get(http.MethodHead, "example.com", "/.well-known/acme-challenge/tok_en-1")
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 || rec.Header().Get("Content-Length") != "14" {
+		t.Errorf("Wrong HEAD answer: %v %q %v", rec.Code, rec.Body, rec.Header())
+	}
+
+	for _, path := range []string{"/.well-known/acme-challenge/unknown", "/.well-known/acme-challenge/tok_en-1/x", "/tok_en-1"} {
+		if rec = get(http.MethodGet, "example.com", path); rec.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for %v: %v", path, rec.Code)
+		}
+	}
+
+	strictHost = true
+	defer func() { strictHost = false }()
+	if rec = get(http.MethodGet, "other.org", "/.well-known/acme-challenge/tok_en-1"); rec.Code != http.StatusNotFound {
+		t.Errorf("Token served for another host: %v", rec.Code)
+	}
+	if rec = get(http.MethodGet, "EXAMPLE.com:5002", "/.well-known/acme-challenge/tok_en-1"); rec.Code != http.StatusOK {
+		t.Errorf("Token not served for its host: %v", rec.Code)
+	}
+
+	// Validators may query while other challenges are presented
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_ = Solver{}.Present(context.Background(), "example.net", "other", "other.thumb")
+		}()
+		go func() {
+			defer wg.Done()
+			if rec := get(http.MethodGet, "example.com", "/.well-known/acme-challenge/tok_en-1"); rec.Code != http.StatusOK {
+				t.Errorf("Concurrent request failed: %v", rec.Code)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestFallback(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Host+r.URL.Path)
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+	defer func() { fallback = nil }()
+
+	fallback = newProxy(target)
+	if rec := get(http.MethodGet, "example.com", "/app"); rec.Code != http.StatusOK || rec.Body.String() != "example.com/app" {
+		t.Errorf("Wrong proxied answer: %v %q", rec.Code, rec.Body)
+	}
+	if rec := get(http.MethodGet, "example.com", "/.well-known/acme-challenge/unknown"); rec.Code != http.StatusNotFound {
+		t.Errorf("Challenge path proxied: %v", rec.Code)
+	}
+
+	fallback = http.HandlerFunc(redirectHTTPS)
+	for host, location := range map[string]string{
+		"example.com:5002": "https://example.com/app?x=1",
+		"example.com":      "https://example.com/app?x=1",
+		"[::1]:80":         "https://[::1]/app?x=1",
+		"[::1]":            "https://[::1]/app?x=1",
+	} {
+		if rec := get(http.MethodGet, host, "/app?x=1"); rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != location {
+			t.Errorf("Wrong redirect of %v: %v %v", host, rec.Code, rec.Header())
+		}
+	}
+}
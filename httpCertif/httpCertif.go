@@ -1,35 +1,71 @@
 package httpCertif
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/logger"
-	"log/slog"
 	"net/http"
+	"sync"
 )
 
 // Server store the server object. Used to shut down from outside context.
 var Server *http.Server
 
+// OCSP refresh of Certificates, started once by HTTPCertificate and stopped by Shutdown
+var (
+	refreshOnce             sync.Once
+	refreshCtx, stopRefresh = context.WithCancel(context.Background())
+)
+
 func handler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func HTTPCertificate(certBody string, certKey string) {
-
-	cert, err := tls.X509KeyPair([]byte(certBody), []byte(certKey))
-	if err != nil {
-		slog.Error("Could not start http Certificate server", "err", err)
+// statusHandler lists the served certificates as JSON, for monitoring.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(Certificates.Status()); err != nil {
+		logger.Logger().Error().Msgf("Error while writing certificate status: %v", err)
 	}
+}
 
-	Server = &http.Server{
-		Addr:    "0.0.0.0:5001",
-		Handler: http.HandlerFunc(handler),
-		TLSConfig: &tls.Config{
-			Certificates: []tls.Certificate{cert},
-		},
-	}
+// HTTPCertificate serves HTTPS with the certificates of Certificates, selected by SNI, following the TLS policy of
+// cfg. It keeps the OCSP staples of the certificates fresh.
+func HTTPCertificate(cfg Config) {
+	refreshOnce.Do(func() { go Certificates.RefreshOCSP(refreshCtx) })
+
+	Server = newServer(cfg, "0.0.0.0:5001")
 	if err := Server.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		logger.Logger().Error().Msgf("Could not start http certificate server: %v", err)
 	}
 }
+
+// newServer returns the certificate server listening on addr, following the TLS policy of cfg.
+func newServer(cfg Config, addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /certificates", statusHandler)
+	mux.HandleFunc("/", handler)
+
+	server := &http.Server{
+		Addr:      addr,
+		Handler:   cfg.withHSTS(mux),
+		TLSConfig: cfg.tlsConfig(),
+	}
+	// A non-nil empty map keeps the server from offering h2 through ALPN
+	if cfg.DisableHTTP2 {
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	return server
+}
+
+// Shutdown stops the OCSP refresh and the HTTPS server, if started.
+func Shutdown(ctx context.Context) error {
+	stopRefresh()
+	if Server == nil {
+		return nil
+	}
+	return Server.Shutdown(ctx)
+}
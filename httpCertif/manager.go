@@ -0,0 +1,252 @@
+package httpCertif
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/logger"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Certificates served by the HTTPS server, renewed certificates are put there again
+var Certificates = NewManager()
+
+// certificateSet is an immutable snapshot of the managed certificates, replaced as a whole on every change
+type certificateSet struct {
+	// names of the certificates, in the order they were first put
+	names []string
+	// byName maps the managed names to their certificate
+	byName map[string]*tls.Certificate
+	// bySAN maps every lower case DNS name of the certificates, wildcards included, to the certificates covering it
+	bySAN map[string][]*tls.Certificate
+	// revoked names of the certificates known to be revoked, still served but no longer stapled
+	revoked map[string]bool
+}
+
+// Manager holds the certificates of the HTTPS server and selects them by SNI. Putting a certificate swaps in a new
+// snapshot atomically: handshakes in progress keep the certificate they selected and no connection is dropped.
+type Manager struct {
+	// mu serializes the writers, readers only load current
+	mu      sync.Mutex
+	current atomic.Pointer[certificateSet]
+
+	// ocsp configures the stapling, ocspRefresh is when the staple of each stapled name must be refreshed
+	ocsp        OCSPConfig
+	ocspRefresh map[string]time.Time
+}
+
+// NewManager returns a Manager without certificates.
+func NewManager() *Manager {
+	m := &Manager{ocspRefresh: make(map[string]time.Time)}
+	m.current.Store(&certificateSet{byName: map[string]*tls.Certificate{}, bySAN: map[string][]*tls.Certificate{}, revoked: map[string]bool{}})
+	return m
+}
+
+// Put serves cert under name, replacing the certificate previously put under the same name (e.g. after a renewal).
+// Certificates requiring an OCSP staple are only served once a staple is fetched, except those the OCSP responder reports
+// as revoked: they are served without staple and flagged in their status.
+func (m *Manager) Put(name string, cert tls.Certificate) error {
+	if len(cert.Certificate) == 0 {
+		return errors.New("empty certificate chain")
+	}
+	if cert.Leaf == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+		cert.Leaf = leaf
+	}
+	if err := checkChain(cert); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	stapled := m.ocsp.Enabled || mustStaple(cert.Leaf)
+	m.mu.Unlock()
+
+	var refresh time.Time
+	revoked := false
+	if stapled {
+		staple, next, err := m.fetchOCSP(&cert)
+		switch {
+		case errors.Is(err, errRevoked):
+			logger.Logger().Error().Msgf("Serving %v without OCSP staple: %v", name, err)
+			stapled, revoked = false, true
+		case err != nil && mustStaple(cert.Leaf):
+			return fmt.Errorf("Must-Staple certificate without OCSP staple: %w", err)
+		case err != nil:
+			logger.Logger().Warn().Msgf("Serving %v without OCSP staple: %v", name, err)
+			refresh = time.Now().Add(ocspRetryInterval)
+		default:
+			cert.OCSPStaple, refresh = staple, next
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.store(name, &cert, revoked)
+	if stapled {
+		m.ocspRefresh[name] = refresh
+	} else {
+		delete(m.ocspRefresh, name)
+	}
+	return nil
+}
+
+// store swaps in a snapshot serving cert under name, flagged as revoked or not, m.mu must be held.
+func (m *Manager) store(name string, cert *tls.Certificate, revoked bool) {
+	old := m.current.Load()
+	next := &certificateSet{
+		names:   old.names,
+		byName:  make(map[string]*tls.Certificate, len(old.byName)+1),
+		bySAN:   make(map[string][]*tls.Certificate),
+		revoked: make(map[string]bool, len(old.revoked)+1),
+	}
+	for n, c := range old.byName {
+		next.byName[n] = c
+	}
+	for n := range old.revoked {
+		next.revoked[n] = true
+	}
+	if revoked {
+		next.revoked[name] = true
+	} else {
+		delete(next.revoked, name)
+	}
+	if _, ok := next.byName[name]; !ok {
+		next.names = append(append([]string{}, old.names...), name)
+	}
+	next.byName[name] = cert
+
+	for _, n := range next.names {
+		c := next.byName[n]
+		for _, san := range c.Leaf.DNSNames {
+			san = strings.ToLower(san)
+			next.bySAN[san] = append(next.bySAN[san], c)
+		}
+	}
+
+	m.current.Store(next)
+}
+
+// checkChain verifies that the chain of cert is ordered leaf first, each certificate followed by its issuer.
+func checkChain(cert tls.Certificate) error {
+	prev := cert.Leaf
+	for i, der := range cert.Certificate[1:] {
+		next, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("certificate %v of the chain: %w", i+1, err)
+		}
+		if !bytes.Equal(prev.RawIssuer, next.RawSubject) || prev.CheckSignatureFrom(next) != nil {
+			return fmt.Errorf("certificate %v of the chain (%v) is not the issuer of %v", i+1, next.Subject, prev.Subject)
+		}
+		prev = next
+	}
+	return nil
+}
+
+// CertificateStatus describes a served certificate, as listed by the status endpoint.
+type CertificateStatus struct {
+	Name      string    `json:"name"`
+	Subject   string    `json:"subject"`
+	SANs      []string  `json:"sans"`
+	Issuer    string    `json:"issuer"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	// SHA256 is the hex encoded SHA-256 fingerprint of the leaf
+	SHA256 string `json:"sha256"`
+	// Chain is the number of certificates sent, leaf included
+	Chain       int  `json:"chain"`
+	OCSPStapled bool `json:"ocspStapled"`
+	// Revoked tells that the certificate is known to be revoked
+	Revoked bool `json:"revoked"`
+}
+
+// Status describes the managed certificates, in the order they were first put.
+func (m *Manager) Status() []CertificateStatus {
+	set := m.current.Load()
+	statuses := make([]CertificateStatus, 0, len(set.names))
+	for _, name := range set.names {
+		cert := set.byName[name]
+		leaf := cert.Leaf
+
+		sans := append([]string{}, leaf.DNSNames...)
+		for _, ip := range leaf.IPAddresses {
+			sans = append(sans, ip.String())
+		}
+		fingerprint := sha256.Sum256(leaf.Raw)
+
+		statuses = append(statuses, CertificateStatus{
+			Name:        name,
+			Subject:     leaf.Subject.String(),
+			SANs:        sans,
+			Issuer:      leaf.Issuer.String(),
+			Serial:      hex.EncodeToString(leaf.SerialNumber.Bytes()),
+			NotBefore:   leaf.NotBefore,
+			NotAfter:    leaf.NotAfter,
+			SHA256:      hex.EncodeToString(fingerprint[:]),
+			Chain:       len(cert.Certificate),
+			OCSPStapled: len(cert.OCSPStaple) > 0,
+			Revoked:     set.revoked[name],
+		})
+	}
+	return statuses
+}
+
+// PutPEM serves the PEM encoded chain and private key under name.
+func (m *Manager) PutPEM(name string, certPEM string, keyPEM string) error {
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return err
+	}
+	return m.Put(name, cert)
+}
+
+// Get returns the certificate put under name.
+func (m *Manager) Get(name string) (*tls.Certificate, bool) {
+	cert, ok := m.current.Load().byName[name]
+	return cert, ok
+}
+
+// Names returns the names of the managed certificates, in the order they were first put.
+func (m *Manager) Names() []string {
+	return m.current.Load().names
+}
+
+// GetCertificate selects the certificate for the SNI of hello: an exact SAN first, then a wildcard SAN covering it.
+// Clients without SNI, or asking for an unknown name, get the first managed certificate.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	set := m.current.Load()
+	if len(set.names) == 0 {
+		return nil, errors.New("no certificate to serve")
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name != "" {
+		candidates := set.bySAN[name]
+		if len(candidates) == 0 {
+			if _, parent, found := strings.Cut(name, "."); found {
+				candidates = set.bySAN["*."+parent]
+			}
+		}
+		// Prefer a certificate whose key type the client supports, e.g. ECDSA
+		for i := len(candidates) - 1; i >= 0; i-- {
+			if hello.SupportsCertificate(candidates[i]) == nil {
+				return candidates[i], nil
+			}
+		}
+		if len(candidates) > 0 {
+			return candidates[len(candidates)-1], nil
+		}
+	}
+
+	return set.byName[set.names[0]], nil
+}
@@ -0,0 +1,134 @@
+package httpCertif
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// selfSigned returns a self-signed certificate for names.
+func selfSigned(t *testing.T, names ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestGetCertificate(t *testing.T) {
+	m := NewManager()
+	if _, err := m.GetCertificate(&tls.ClientHelloInfo{}); err == nil {
+		t.Error("Certificate served without any")
+	}
+
+	_ = m.Put("example.com", selfSigned(t, "example.com", "www.example.com"))
+	_ = m.Put("example.org", selfSigned(t, "*.example.org"))
+
+	serves := func(sni string, want string) {
+		t.Helper()
+		cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: sni})
+		if err != nil || cert.Leaf.DNSNames[0] != want {
+			t.Errorf("Wrong certificate for %q: %v %v", sni, cert.Leaf.DNSNames, err)
+		}
+	}
+	serves("WWW.example.com", "example.com")
+	serves("a.example.org", "*.example.org")
+	serves("a.b.example.org", "example.com")
+	serves("", "example.com")
+
+	// A renewal replaces the certificate of its name
+	renewed := selfSigned(t, "example.com", "api.example.com")
+	_ = m.Put("example.com", renewed)
+	serves("api.example.com", "example.com")
+	if cert, _ := m.Get("example.com"); cert.Leaf.DNSNames[1] != "api.example.com" || len(m.Names()) != 2 {
+		t.Errorf("Certificate not replaced: %v %v", cert.Leaf.DNSNames, m.Names())
+	}
+}
+
+func TestChainAndStatus(t *testing.T) {
+	m := NewManager()
+	cert, _, _ := issued(t, "example.com", false)
+
+	other, _, _ := issued(t, "example.org", false)
+	for _, chain := range [][][]byte{{cert.Certificate[1], cert.Certificate[0]}, {cert.Certificate[0], other.Certificate[1]}} {
+		wrong := cert
+		wrong.Certificate = chain
+		if err := m.Put("example.com", wrong); err == nil {
+			t.Error("Chain not ordered leaf then issuers accepted")
+		}
+	}
+
+	// A leaf without issuer is a complete chain
+	leafOnly := other
+	leafOnly.Certificate = other.Certificate[:1]
+	if err := m.Put("example.org", leafOnly); err != nil {
+		t.Errorf("Leaf-only chain refused: %v", err)
+	}
+	m = NewManager()
+
+	if err := m.Put("example.com", cert); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	status := m.Status()
+	if len(status) != 1 || status[0].SANs[0] != "example.com" || status[0].Issuer != "CN=Test CA" || status[0].Chain != 2 || len(status[0].SHA256) != 64 {
+		t.Errorf("Wrong status: %+v", status)
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	defer func(m *Manager) { Certificates = m }(Certificates)
+	Certificates = NewManager()
+
+	get := func() (*httptest.ResponseRecorder, []map[string]any) {
+		rec := httptest.NewRecorder()
+		statusHandler(rec, httptest.NewRequest(http.MethodGet, "/certificates", nil))
+		var body []map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Invalid JSON %q: %v", rec.Body, err)
+		}
+		return rec, body
+	}
+	if rec, body := get(); rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" || body == nil || len(body) != 0 {
+		t.Errorf("Wrong empty status: %v %v %q", rec.Code, rec.Header(), rec.Body)
+	}
+
+	cert := selfSigned(t, "example.com", "www.example.com")
+	_ = Certificates.Put("example.com", cert)
+	_, body := get()
+	if len(body) != 1 {
+		t.Fatalf("Wrong status: %v", body)
+	}
+	want := map[string]any{"name": "example.com", "subject": "CN=example.com", "sans": []any{"example.com", "www.example.com"},
+		"chain": float64(1), "ocspStapled": false, "revoked": false}
+	for key, value := range want {
+		if !reflect.DeepEqual(body[0][key], value) {
+			t.Errorf("Wrong %v: %v", key, body[0][key])
+		}
+	}
+	for _, key := range []string{"issuer", "serial", "notBefore", "notAfter", "sha256"} {
+		if _, ok := body[0][key]; !ok {
+			t.Errorf("Missing %v: %v", key, body[0])
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package httpCertif
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/logger"
+	"io"
+	"net/http"
+	"time"
+)
+
+// OIDExtensionTLSFeature identifies the TLS Feature extension carrying Must-Staple (RFC 7633)
+var OIDExtensionTLSFeature = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+
+// TLSFeatureStatusRequest is the status_request TLS extension required by Must-Staple certificates
+const TLSFeatureStatusRequest = 5
+
+// OCSP refresh timing
+const (
+	// ocspRetryInterval delay before fetching again a staple that could not be fetched
+	ocspRetryInterval = 1 * time.Minute
+	// ocspDefaultValidity validity assumed for responses without NextUpdate
+	ocspDefaultValidity = 1 * time.Hour
+	// ocspCheckInterval how often the staples are checked for refresh
+	ocspCheckInterval = 1 * time.Minute
+)
+
+// maxOCSPResponseSize bounds the OCSP responses read from the responders
+const maxOCSPResponseSize = 1 << 20
+
+// ocspClient sends the OCSP requests when OCSPConfig has no client, a hung responder must not hold up the issuance
+var ocspClient = &http.Client{Timeout: 10 * time.Second}
+
+// errRevoked is returned for the certificates the OCSP responder reports as revoked, whose response is not stapled
+var errRevoked = errors.New("certificate revoked")
+
+// OCSPConfig configures the OCSP stapling of a Manager.
+type OCSPConfig struct {
+	// Enabled staples every certificate, Must-Staple certificates are stapled in any case
+	Enabled bool
+	// Responder overrides the OCSP URL of the certificates (AIA extension), e.g. with a local responder stand-in
+	Responder string
+	// Client sends the OCSP requests, a client with a 10s timeout when nil
+	Client *http.Client
+}
+
+// ConfigureOCSP sets how the certificates put afterwards are stapled.
+func (m *Manager) ConfigureOCSP(cfg OCSPConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ocsp = cfg
+}
+
+// mustStaple tells whether leaf carries the Must-Staple TLS Feature.
+func mustStaple(leaf *x509.Certificate) bool {
+	for _, ext := range leaf.Extensions {
+		if !ext.Id.Equal(OIDExtensionTLSFeature) {
+			continue
+		}
+		var features []int
+		if _, err := asn1.Unmarshal(ext.Value, &features); err != nil {
+			return false
+		}
+		for _, feature := range features {
+			if feature == TLSFeatureStatusRequest {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fetchOCSP asks the OCSP responder of cert for the status of its leaf. It returns the DER response to staple and when
+// it must be refreshed: halfway through its validity, so that a failing responder leaves time to retry.
+func (m *Manager) fetchOCSP(cert *tls.Certificate) ([]byte, time.Time, error) {
+	m.mu.Lock()
+	cfg := m.ocsp
+	m.mu.Unlock()
+
+	if len(cert.Certificate) < 2 {
+		return nil, time.Time{}, errors.New("no issuer in the certificate chain")
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	responder := cfg.Responder
+	if responder == "" {
+		if len(cert.Leaf.OCSPServer) == 0 {
+			return nil, time.Time{}, errors.New("no OCSP responder in the certificate")
+		}
+		responder = cert.Leaf.OCSPServer[0]
+	}
+	client := cfg.Client
+	if client == nil {
+		client = ocspClient
+	}
+
+	req, err := createOCSPRequest(cert.Leaf, issuer)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	res, err := client.Post(responder, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("OCSP responder %v answered %v", responder, res.Status)
+	}
+	raw, err := io.ReadAll(io.LimitReader(res.Body, maxOCSPResponseSize))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	status, err := parseOCSPResponse(raw, cert.Leaf, issuer)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if status.Revoked {
+		logger.Logger().Error().Msgf("OCSP responder %v reports certificate %x as revoked", responder, cert.Leaf.SerialNumber)
+		return nil, time.Time{}, fmt.Errorf("%w at %v", errRevoked, status.RevokedAt)
+	}
+
+	now := time.Now()
+	nextUpdate := status.NextUpdate
+	if nextUpdate.IsZero() {
+		nextUpdate = now.Add(ocspDefaultValidity)
+	}
+	if !nextUpdate.After(now) {
+		return nil, time.Time{}, fmt.Errorf("OCSP response expired at %v", nextUpdate)
+	}
+	refresh := status.ThisUpdate.Add(nextUpdate.Sub(status.ThisUpdate) / 2)
+	if refresh.Before(now.Add(ocspRetryInterval)) {
+		refresh = now.Add(ocspRetryInterval)
+	}
+
+	logger.Logger().Debug().Msgf("OCSP staple fetched for %v, valid until %v", cert.Leaf.Subject, nextUpdate)
+	return raw, refresh, nil
+}
+
+// MarkRevoked flags the certificate of name as revoked. It is still served, without OCSP staple.
+func (m *Manager) MarkRevoked(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.markRevoked(name)
+}
+
+// markRevoked drops the staple of the certificate of name, no longer refreshed, and flags it as revoked; m.mu must be
+// held.
+func (m *Manager) markRevoked(name string) {
+	cert, ok := m.current.Load().byName[name]
+	if !ok {
+		return
+	}
+	unstapled := *cert
+	unstapled.OCSPStaple = nil
+	m.store(name, &unstapled, true)
+	delete(m.ocspRefresh, name)
+}
+
+// refreshOCSP fetches the staples whose refresh time is over and swaps in the certificates with the new staples.
+func (m *Manager) refreshOCSP(now time.Time) {
+	m.mu.Lock()
+	due := make(map[string]*tls.Certificate)
+	for name, refresh := range m.ocspRefresh {
+		if !now.Before(refresh) {
+			due[name] = m.current.Load().byName[name]
+		}
+	}
+	m.mu.Unlock()
+
+	for name, cert := range due {
+		staple, refresh, err := m.fetchOCSP(cert)
+		if err != nil {
+			logger.Logger().Error().Msgf("Could not refresh the OCSP staple of %v: %v", name, err)
+			refresh = now.Add(ocspRetryInterval)
+		}
+
+		m.mu.Lock()
+		// A certificate renewed meanwhile was stapled by Put
+		if m.current.Load().byName[name] == cert {
+			if errors.Is(err, errRevoked) {
+				m.markRevoked(name)
+			} else {
+				if err == nil {
+					stapled := *cert
+					stapled.OCSPStaple = staple
+					m.store(name, &stapled, false)
+				}
+				m.ocspRefresh[name] = refresh
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// RefreshOCSP keeps the OCSP staples fresh until ctx is done.
+func (m *Manager) RefreshOCSP(ctx context.Context) {
+	ticker := time.NewTicker(ocspCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			m.refreshOCSP(now)
+		}
+	}
+}
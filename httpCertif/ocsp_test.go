@@ -0,0 +1,200 @@
+package httpCertif
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// createOCSPResponse returns the DER OCSP response holding single, signed by key on behalf of ca.
+func createOCSPResponse(t *testing.T, ca *x509.Certificate, single singleResponse, key *ecdsa.PrivateKey) []byte {
+	tbs, err := asn1.Marshal(responseData{
+		RawResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true, Bytes: ca.RawSubject},
+		ProducedAt:     single.ThisUpdate,
+		Responses:      []singleResponse{single},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(tbs)
+	signature, _ := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	basic, err := asn1.Marshal(basicResponse{
+		TBSResponseData:    responseData{Raw: tbs},
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}},
+		Signature:          asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := asn1.Marshal(ocspResponse{Response: responseBytes{ResponseType: oidOCSPBasic, Response: basic}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// issued returns a certificate for name signed by a fresh CA, whose OCSP requests go to responder. The stand-in
+// responder answers good for every serial number, revoked on /revoked, signed by another key on /forged, and counts
+// the requests.
+func issued(t *testing.T, name string, mustStaple bool) (tls.Certificate, *httptest.Server, *atomic.Int32) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, _ := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	ca, _ := x509.ParseCertificate(caDER)
+
+	var requests atomic.Int32
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		var req ocspRequest
+		if _, err := asn1.Unmarshal(body, &req); err != nil || len(req.TBSRequest.RequestList) != 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		single := singleResponse{
+			CertID:     req.TBSRequest.RequestList[0].Cert,
+			Good:       true,
+			ThisUpdate: time.Now().Add(-time.Minute).UTC().Truncate(time.Second),
+			NextUpdate: time.Now().Add(time.Hour).UTC().Truncate(time.Second),
+		}
+		if r.URL.Path == "/revoked" {
+			single.Good = false
+			single.Revoked = revokedInfo{RevocationTime: single.ThisUpdate}
+		}
+		signer := caKey
+		if r.URL.Path == "/forged" {
+			signer, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		}
+		_, _ = w.Write(createOCSPResponse(t, ca, single, signer))
+	}))
+	t.Cleanup(responder.Close)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		OCSPServer:   []string{responder.URL},
+	}
+	if mustStaple {
+		value, _ := asn1.Marshal([]int{TLSFeatureStatusRequest})
+		tmpl.ExtraExtensions = []pkix.Extension{{Id: OIDExtensionTLSFeature, Value: value}}
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	return tls.Certificate{Certificate: [][]byte{der, caDER}, PrivateKey: key}, responder, &requests
+}
+
+func TestOCSPStapling(t *testing.T) {
+	m := NewManager()
+
+	// Must-Staple certificates are stapled even when stapling is not enabled
+	cert, _, requests := issued(t, "example.com", true)
+	if err := m.Put("example.com", cert); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	served, _ := m.Get("example.com")
+	if len(served.OCSPStaple) == 0 || requests.Load() != 1 {
+		t.Fatalf("Must-Staple certificate not stapled")
+	}
+
+	// Staples are refreshed halfway through their validity only
+	m.refreshOCSP(time.Now())
+	if requests.Load() != 1 {
+		t.Errorf("Fresh staple fetched again")
+	}
+	m.refreshOCSP(time.Now().Add(40 * time.Minute))
+	if requests.Load() != 2 {
+		t.Errorf("Staple not refreshed")
+	}
+
+	// A Must-Staple certificate is not served without staple
+	cert, responder, _ := issued(t, "example.org", true)
+	responder.Close()
+	if err := m.Put("example.org", cert); err == nil {
+		t.Error("Must-Staple certificate served without staple")
+	}
+
+	// Nor with a staple that is not signed by its issuer
+	cert, responder, _ = issued(t, "example.org", true)
+	m.ConfigureOCSP(OCSPConfig{Responder: responder.URL + "/forged"})
+	if err := m.Put("example.org", cert); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Errorf("Forged OCSP response accepted: %v", err)
+	}
+
+	// The responder of the certificate can be replaced by a stand-in
+	cert, _, _ = issued(t, "example.net", false)
+	_, standIn, standInRequests := issued(t, "other.net", false)
+	m.ConfigureOCSP(OCSPConfig{Enabled: true, Responder: standIn.URL})
+	_ = m.Put("example.net", cert)
+	if standInRequests.Load() != 1 {
+		t.Errorf("Stand-in responder not used")
+	}
+}
+
+func TestOCSPRevoked(t *testing.T) {
+	m := NewManager()
+	cert, responder, _ := issued(t, "example.com", true)
+	m.ConfigureOCSP(OCSPConfig{Responder: responder.URL + "/revoked"})
+	if err := m.Put("example.com", cert); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	served, _ := m.Get("example.com")
+	if status := m.Status(); len(served.OCSPStaple) != 0 || !status[0].Revoked {
+		t.Errorf("Revoked response stapled: %+v", status)
+	}
+
+	// A certificate revoked while served loses its staple at the next refresh
+	m.ConfigureOCSP(OCSPConfig{Responder: responder.URL})
+	if err := m.Put("example.com", cert); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if status := m.Status(); !status[0].OCSPStapled || status[0].Revoked {
+		t.Fatalf("Good response not stapled: %+v", status)
+	}
+	m.ConfigureOCSP(OCSPConfig{Responder: responder.URL + "/revoked"})
+	m.refreshOCSP(time.Now().Add(time.Hour))
+	if status := m.Status(); status[0].OCSPStapled || !status[0].Revoked {
+		t.Errorf("Revoked certificate still stapled: %+v", status)
+	}
+	if _, ok := m.ocspRefresh["example.com"]; ok {
+		t.Error("Revoked certificate still refreshed")
+	}
+}
+
+func TestRefreshOCSPStops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		NewManager().RefreshOCSP(ctx)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("RefreshOCSP not stopped")
+	}
+}
@@ -0,0 +1,236 @@
+package httpCertif
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	// Registers SHA-1 for the CertID hashes, SHA-256 and up are registered by crypto/x509
+	_ "crypto/sha1"
+)
+
+// OCSP messages of RFC 6960, encoded with encoding/asn1
+
+// ocspRequest is the OCSPRequest of RFC 6960 4.1.1, unsigned and for a single certificate
+type ocspRequest struct {
+	TBSRequest tbsRequest
+}
+
+type tbsRequest struct {
+	Version     int `asn1:"explicit,tag:0,default:0,optional"`
+	RequestList []singleRequest
+}
+
+type singleRequest struct {
+	Cert certID
+}
+
+// certID identifies a certificate by its serial number and the hashes of the name and key of its issuer
+type certID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+// ocspResponse is the OCSPResponse of RFC 6960 4.2.1
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response responseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type responseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+// basicResponse is the BasicOCSPResponse, signed by the issuer or by a responder certificate the issuer delegated
+type basicResponse struct {
+	TBSResponseData    responseData
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type responseData struct {
+	Raw                asn1.RawContent
+	Version            int `asn1:"explicit,tag:0,default:0,optional"`
+	RawResponderID     asn1.RawValue
+	ProducedAt         time.Time `asn1:"generalized"`
+	Responses          []singleResponse
+	ResponseExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+// singleResponse is the status of one certificate, exactly one of Good, Revoked and Unknown is set
+type singleResponse struct {
+	CertID           certID
+	Good             asn1.Flag        `asn1:"tag:0,optional"`
+	Revoked          revokedInfo      `asn1:"tag:1,optional"`
+	Unknown          asn1.Flag        `asn1:"tag:2,optional"`
+	ThisUpdate       time.Time        `asn1:"generalized"`
+	NextUpdate       time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	SingleExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type revokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+// ocspStatus is the status of a certificate read from an OCSP response
+type ocspStatus struct {
+	Revoked    bool
+	RevokedAt  time.Time
+	ThisUpdate time.Time
+	// NextUpdate is zero when the responder does not tell
+	NextUpdate time.Time
+}
+
+var (
+	// oidOCSPBasic is the response type of the BasicOCSPResponse
+	oidOCSPBasic = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	// oidSHA1 and oidSHA256 are the hash algorithms accepted in the CertID
+	oidSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+)
+
+// ocspSignatureAlgorithms maps the OIDs of the signature algorithms of the responses to their x509 counterpart
+var ocspSignatureAlgorithms = map[string]x509.SignatureAlgorithm{
+	"1.2.840.113549.1.1.5":  x509.SHA1WithRSA,
+	"1.2.840.113549.1.1.11": x509.SHA256WithRSA,
+	"1.2.840.113549.1.1.12": x509.SHA384WithRSA,
+	"1.2.840.113549.1.1.13": x509.SHA512WithRSA,
+	"1.2.840.10045.4.3.2":   x509.ECDSAWithSHA256,
+	"1.2.840.10045.4.3.3":   x509.ECDSAWithSHA384,
+	"1.2.840.10045.4.3.4":   x509.ECDSAWithSHA512,
+	"1.3.101.112":           x509.PureEd25519,
+}
+
+// newCertID returns the CertID of leaf issued by issuer, hashed with hash.
+func newCertID(leaf *x509.Certificate, issuer *x509.Certificate, hash crypto.Hash) (certID, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return certID{}, err
+	}
+	oid := oidSHA1
+	if hash == crypto.SHA256 {
+		oid = oidSHA256
+	}
+
+	h := hash.New()
+	h.Write(issuer.RawSubject)
+	nameHash := h.Sum(nil)
+	h.Reset()
+	h.Write(spki.PublicKey.RightAlign())
+	return certID{
+		HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oid, Parameters: asn1.NullRawValue},
+		NameHash:      nameHash,
+		IssuerKeyHash: h.Sum(nil),
+		SerialNumber:  leaf.SerialNumber,
+	}, nil
+}
+
+// createOCSPRequest returns the DER OCSP request for the status of leaf, identified with SHA-1 as most responders
+// expect.
+func createOCSPRequest(leaf *x509.Certificate, issuer *x509.Certificate) ([]byte, error) {
+	id, err := newCertID(leaf, issuer, crypto.SHA1)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(ocspRequest{TBSRequest: tbsRequest{RequestList: []singleRequest{{Cert: id}}}})
+}
+
+// parseOCSPResponse checks the signature of the DER OCSP response raw and returns the status of leaf it holds.
+func parseOCSPResponse(raw []byte, leaf *x509.Certificate, issuer *x509.Certificate) (*ocspStatus, error) {
+	var res ocspResponse
+	if rest, err := asn1.Unmarshal(raw, &res); err != nil {
+		return nil, fmt.Errorf("invalid OCSP response: %w", err)
+	} else if len(rest) > 0 {
+		return nil, errors.New("trailing data after the OCSP response")
+	}
+	if res.Status != 0 {
+		return nil, fmt.Errorf("OCSP responder failed with status %v", res.Status)
+	}
+	if !res.Response.ResponseType.Equal(oidOCSPBasic) {
+		return nil, fmt.Errorf("unsupported OCSP response type %v", res.Response.ResponseType)
+	}
+	var basic basicResponse
+	if _, err := asn1.Unmarshal(res.Response.Response, &basic); err != nil {
+		return nil, fmt.Errorf("invalid basic OCSP response: %w", err)
+	}
+
+	signer, err := ocspSigner(basic, issuer)
+	if err != nil {
+		return nil, err
+	}
+	algorithm, ok := ocspSignatureAlgorithms[basic.SignatureAlgorithm.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported OCSP signature algorithm %v", basic.SignatureAlgorithm.Algorithm)
+	}
+	if err := signer.CheckSignature(algorithm, basic.TBSResponseData.Raw, basic.Signature.RightAlign()); err != nil {
+		return nil, fmt.Errorf("invalid OCSP response signature: %w", err)
+	}
+
+	for _, single := range basic.TBSResponseData.Responses {
+		if !matchCertID(single.CertID, leaf, issuer) {
+			continue
+		}
+		if single.Unknown {
+			return nil, errors.New("OCSP responder does not know the certificate")
+		}
+		return &ocspStatus{
+			Revoked:    !bool(single.Good),
+			RevokedAt:  single.Revoked.RevocationTime,
+			ThisUpdate: single.ThisUpdate,
+			NextUpdate: single.NextUpdate,
+		}, nil
+	}
+	return nil, errors.New("no status of the certificate in the OCSP response")
+}
+
+// ocspSigner returns the certificate signing the response: issuer itself, or the OCSP signing certificate it
+// delegated and which is sent with the response.
+func ocspSigner(basic basicResponse, issuer *x509.Certificate) (*x509.Certificate, error) {
+	if len(basic.Certificates) == 0 {
+		return issuer, nil
+	}
+	responder, err := x509.ParseCertificate(basic.Certificates[0].FullBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OCSP responder certificate: %w", err)
+	}
+	if bytes.Equal(responder.Raw, issuer.Raw) {
+		return issuer, nil
+	}
+	if err := responder.CheckSignatureFrom(issuer); err != nil {
+		return nil, fmt.Errorf("OCSP responder certificate not issued by the issuer: %w", err)
+	}
+	for _, usage := range responder.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageOCSPSigning {
+			return responder, nil
+		}
+	}
+	return nil, errors.New("OCSP responder certificate not delegated for OCSP signing")
+}
+
+// matchCertID tells whether id identifies leaf issued by issuer.
+func matchCertID(id certID, leaf *x509.Certificate, issuer *x509.Certificate) bool {
+	hash := crypto.SHA1
+	switch {
+	case id.HashAlgorithm.Algorithm.Equal(oidSHA256):
+		hash = crypto.SHA256
+	case !id.HashAlgorithm.Algorithm.Equal(oidSHA1):
+		return false
+	}
+	want, err := newCertID(leaf, issuer, hash)
+	return err == nil && id.SerialNumber != nil && id.SerialNumber.Cmp(want.SerialNumber) == 0 &&
+		bytes.Equal(id.NameHash, want.NameHash) && bytes.Equal(id.IssuerKeyHash, want.IssuerKeyHash)
+}
@@ -0,0 +1,130 @@
+package httpCertif
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// tlsVersions maps the accepted --tls-min-version values to their TLS version
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// curves maps the accepted curve names to their ID
+var curves = map[string]tls.CurveID{
+	"x25519": tls.X25519,
+	"p-256":  tls.CurveP256,
+	"p-384":  tls.CurveP384,
+	"p-521":  tls.CurveP521,
+}
+
+// Config is the TLS policy of the certificate server, zero values keep the Go defaults.
+type Config struct {
+	// MinVersion is the minimum TLS version, e.g. tls.VersionTLS13
+	MinVersion uint16
+	// CipherSuites enabled for TLS 1.2 and below, TLS 1.3 suites are not configurable
+	CipherSuites []uint16
+	// CurvePreferences orders the key exchange curves
+	CurvePreferences []tls.CurveID
+	// DisableHTTP2 only offers HTTP/1.1 through ALPN
+	DisableHTTP2 bool
+	// HSTS is the max-age of the Strict-Transport-Security header, no header when zero
+	HSTS time.Duration
+	// HSTSSubdomains adds includeSubDomains to the Strict-Transport-Security header
+	HSTSSubdomains bool
+	// ClientCAs, when set, requires client certificates issued by one of these CAs (mTLS)
+	ClientCAs *x509.CertPool
+}
+
+// tlsConfig returns the tls.Config of the policy, serving the certificates of Certificates.
+func (cfg Config) tlsConfig() *tls.Config {
+	tlsCfg := &tls.Config{
+		GetCertificate:   Certificates.GetCertificate,
+		MinVersion:       cfg.MinVersion,
+		CipherSuites:     cfg.CipherSuites,
+		CurvePreferences: cfg.CurvePreferences,
+	}
+	if cfg.ClientCAs != nil {
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsCfg.ClientCAs = cfg.ClientCAs
+	}
+	return tlsCfg
+}
+
+// withHSTS adds the Strict-Transport-Security header of the policy to the answers of next.
+func (cfg Config) withHSTS(next http.Handler) http.Handler {
+	if cfg.HSTS <= 0 {
+		return next
+	}
+	value := fmt.Sprintf("max-age=%d", int64(cfg.HSTS.Seconds()))
+	if cfg.HSTSSubdomains {
+		value += "; includeSubDomains"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ParseTLSVersion parses a TLS version written as 1.0, 1.1, 1.2 or 1.3.
+func ParseTLSVersion(value string) (uint16, error) {
+	version, ok := tlsVersions[value]
+	if !ok {
+		return 0, fmt.Errorf("unsupported TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", value)
+	}
+	return version, nil
+}
+
+// ParseCipherSuites parses a comma separated list of cipher suite names, e.g.
+// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. Only the suites considered secure by crypto/tls are accepted.
+func ParseCipherSuites(value string) ([]uint16, error) {
+	byName := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		byName[suite.Name] = suite.ID
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(value, ",") {
+		id, ok := byName[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unsupported or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ParseCurves parses a comma separated list of curve names: X25519, P-256, P-384 or P-521.
+func ParseCurves(value string) ([]tls.CurveID, error) {
+	var ids []tls.CurveID
+	for _, name := range strings.Split(value, ",") {
+		id, ok := curves[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// LoadCertPool reads the PEM encoded CA certificates of path.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificate found in " + path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,118 @@
+package httpCertif
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParsePolicy(t *testing.T) {
+	if v, err := ParseTLSVersion("1.3"); err != nil || v != tls.VersionTLS13 {
+		t.Errorf("Wrong TLS version: %v %v", v, err)
+	}
+	if suites, err := ParseCipherSuites("TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls_ecdhe_rsa_with_aes_256_gcm_sha384"); err != nil || len(suites) != 2 {
+		t.Errorf("Wrong cipher suites: %v %v", suites, err)
+	}
+	if _, err := ParseCipherSuites("TLS_RSA_WITH_RC4_128_SHA"); err == nil {
+		t.Error("Insecure cipher suite accepted")
+	}
+	if ids, err := ParseCurves("X25519,p-256"); err != nil || len(ids) != 2 || ids[1] != tls.CurveP256 {
+		t.Errorf("Wrong curves: %v %v", ids, err)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	cert, _, _ := issued(t, "example.com", false)
+	Certificates = NewManager()
+	defer func() { Certificates = NewManager() }()
+	if err := Certificates.Put("example.com", cert); err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(cert.Certificate[1])
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	cfg := Config{MinVersion: tls.VersionTLS13, HSTS: 24 * time.Hour, ClientCAs: pool}
+	server := httptest.NewUnstartedServer(cfg.withHSTS(http.HandlerFunc(handler)))
+	server.TLS = cfg.tlsConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	client := func(withCert bool) *http.Client {
+		tlsCfg := &tls.Config{RootCAs: pool, ServerName: "example.com"}
+		if withCert {
+			tlsCfg.Certificates = []tls.Certificate{cert}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+	}
+
+	if _, err := client(false).Get(server.URL); err == nil {
+		t.Error("Client without certificate accepted")
+	}
+	res, err := client(true).Get(server.URL)
+	if err != nil {
+		t.Fatalf("Client certificate refused: %v", err)
+	}
+	res.Body.Close()
+	if res.TLS.Version != tls.VersionTLS13 || res.Header.Get("Strict-Transport-Security") != "max-age=86400" {
+		t.Errorf("Wrong policy: %x %v", res.TLS.Version, res.Header)
+	}
+}
+
+func TestALPNAndCurves(t *testing.T) {
+	cert, _, _ := issued(t, "example.com", false)
+	Certificates = NewManager()
+	defer func() { Certificates = NewManager() }()
+	if err := Certificates.Put("example.com", cert); err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(cert.Certificate[1])
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	serve := func(cfg Config) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := newServer(cfg, ln.Addr().String())
+		go func() { _ = server.ServeTLS(ln, "", "") }()
+		t.Cleanup(func() { _ = server.Close() })
+		return "https://" + ln.Addr().String()
+	}
+	get := func(url string, curves ...tls.CurveID) (*http.Response, error) {
+		tlsCfg := &tls.Config{RootCAs: pool, ServerName: "example.com", CurvePreferences: curves}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg, ForceAttemptHTTP2: true}}
+		res, err := client.Get(url)
+		if err == nil {
+			res.Body.Close()
+		}
+		return res, err
+	}
+
+	for _, test := range []struct {
+		disable  bool
+		protocol string
+		major    int
+	}{{false, "h2", 2}, {true, "http/1.1", 1}} {
+		res, err := get(serve(Config{DisableHTTP2: test.disable}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.TLS.NegotiatedProtocol != test.protocol || res.ProtoMajor != test.major {
+			t.Errorf("Wrong protocol with DisableHTTP2 %v: %q %v", test.disable, res.TLS.NegotiatedProtocol, res.Proto)
+		}
+	}
+
+	url := serve(Config{CurvePreferences: []tls.CurveID{tls.CurveP384}})
+	if _, err := get(url, tls.X25519); err == nil {
+		t.Error("Curve outside CurvePreferences accepted")
+	}
+	if _, err := get(url, tls.X25519, tls.CurveP384); err != nil {
+		t.Errorf("Preferred curve refused: %v", err)
+	}
+}
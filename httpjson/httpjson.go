@@ -0,0 +1,21 @@
+package httpjson
+
+import (
+	"encoding/json"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/logger"
+	"net/http"
+)
+
+// Write answers the request with status and the JSON encoding of v.
+func Write(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Logger().Error().Msgf("Error while writing JSON answer: %v", err)
+	}
+}
+
+// WriteError answers the request with an error, e.g. {"error": "unauthorized"}.
+func WriteError(w http.ResponseWriter, status int, reason string) {
+	Write(w, status, map[string]string{"error": reason})
+}
@@ -0,0 +1,155 @@
+package propagation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/dnsquery"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/logger"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Default values of the optional Checker fields
+const (
+	DefaultTimeout  = 2 * time.Minute
+	DefaultInterval = 2 * time.Second
+	DefaultPort     = "53"
+)
+
+// Checker waits until every authoritative name server of a zone serves a TXT record, so that the ACME server finds
+// it whichever name server it asks.
+type Checker struct {
+	// Resolver is the recursive resolver HOST:PORT used to follow the CNAME delegation of the checked names and to find
+	// their authoritative name servers
+	Resolver string
+	// Nameservers, as HOST:PORT, are queried instead of the authoritative name servers found through Resolver
+	Nameservers []string
+	// Port of the authoritative name servers found through Resolver, DefaultPort when empty
+	Port string
+	// Timeout bounds the wait for one record, DefaultTimeout when zero
+	Timeout time.Duration
+	// Interval between two queries of the same name server, DefaultInterval when zero
+	Interval time.Duration
+}
+
+// Wait queries every authoritative name server of fqdn until they all serve the TXT record fqdn with value. A delegated
+// fqdn is checked at the end of its CNAME chain.
+func (c *Checker) Wait(ctx context.Context, fqdn string, value string) error {
+	timeout, interval := c.Timeout, c.Interval
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	if interval == 0 {
+		interval = DefaultInterval
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if c.Resolver != "" {
+		_, target, err := dnsquery.Follow(ctx, new(dns.Client), c.Resolver, fqdn, dns.TypeTXT)
+		if err != nil {
+			return fmt.Errorf("could not follow the delegation of %v: %w", fqdn, err)
+		}
+		fqdn = target
+	}
+
+	client := new(dns.Client)
+	pending := slices.Clone(c.Nameservers)
+	if len(pending) == 0 {
+		var err error
+		if pending, err = c.authoritative(ctx, client, fqdn); err != nil {
+			return err
+		}
+	}
+
+	for {
+		pending = slices.DeleteFunc(pending, func(server string) bool {
+			return serves(ctx, client, server, fqdn, value)
+		})
+		if len(pending) == 0 {
+			logger.Logger().Debug().Msgf("TXT record %v served by every authoritative name server", fqdn)
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("TXT record %v not served by %v: %w", fqdn, strings.Join(pending, ", "), ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
+
+// authoritative returns the addresses of the name servers of the closest zone enclosing fqdn, found by climbing the
+// DNS tree with the recursive resolver.
+func (c *Checker) authoritative(ctx context.Context, client *dns.Client, fqdn string) ([]string, error) {
+	port := c.Port
+	if port == "" {
+		port = DefaultPort
+	}
+	name := dns.Fqdn(strings.ToLower(fqdn))
+
+	var hosts []string
+	for _, i := range dns.Split(name) {
+		res, err := dnsquery.Exchange(ctx, client, c.Resolver, name[i:], dns.TypeNS, true)
+		if err != nil {
+			return nil, err
+		}
+		for _, rr := range res.Answer {
+			if ns, ok := rr.(*dns.NS); ok && strings.EqualFold(ns.Hdr.Name, name[i:]) {
+				hosts = append(hosts, ns.Ns)
+			}
+		}
+		if len(hosts) > 0 {
+			logger.Logger().Debug().Msgf("Name servers of %v: %v", name[i:], hosts)
+			break
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, errors.New("no authoritative name server found for " + fqdn)
+	}
+
+	var servers []string
+	for _, host := range hosts {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			res, err := dnsquery.Exchange(ctx, client, c.Resolver, host, qtype, true)
+			if err != nil {
+				return nil, err
+			}
+			for _, rr := range res.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					servers = append(servers, net.JoinHostPort(rr.A.String(), port))
+				case *dns.AAAA:
+					servers = append(servers, net.JoinHostPort(rr.AAAA.String(), port))
+				}
+			}
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no address found for the name servers %v of %v", hosts, fqdn)
+	}
+
+	return servers, nil
+}
+
+// serves tells whether server answers the TXT record fqdn with value, following the CNAMEs of the answer.
+func serves(ctx context.Context, client *dns.Client, server string, fqdn string, value string) bool {
+	res, err := dnsquery.Exchange(ctx, client, server, fqdn, dns.TypeTXT, false)
+	if err != nil {
+		logger.Logger().Debug().Msgf("Could not query %v for %v: %v", server, fqdn, err)
+		return false
+	}
+
+	records, _ := dnsquery.Answer(res, fqdn, dns.TypeTXT)
+	for _, rr := range records {
+		if strings.Join(rr.(*dns.TXT).Txt, "") == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package propagation
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startServer serves example.com, whose TXT record at name appears after delay queries, as both the recursive resolver
+// and the only authoritative name server of the zone.
+func startServer(t *testing.T, name string, value string, delay int32) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var txtQueries atomic.Int32
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg).SetReply(r)
+		q := r.Question[0]
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+		switch {
+		case q.Qtype == dns.TypeNS && q.Name == "example.com.":
+			m.Answer = append(m.Answer, &dns.NS{Hdr: hdr, Ns: "ns1.example.com."})
+		case q.Qtype == dns.TypeA && q.Name == "ns1.example.com.":
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.ParseIP("127.0.0.1")})
+		case q.Qtype == dns.TypeTXT && q.Name == name && txtQueries.Add(1) > delay:
+			m.Answer = append(m.Answer, &dns.TXT{Hdr: hdr, Txt: []string{value}})
+		}
+		_ = w.WriteMsg(m)
+	})
+
+	server := &dns.Server{PacketConn: pc, Handler: handler}
+	go func() { _ = server.ActivateAndServe() }()
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestWait(t *testing.T) {
+	name := "_acme-challenge.www.example.com."
+	addr := startServer(t, name, "value", 2)
+	_, port, _ := net.SplitHostPort(addr)
+
+	checker := &Checker{Resolver: addr, Port: port, Interval: 10 * time.Millisecond, Timeout: time.Second}
+	if err := checker.Wait(context.Background(), name, "value"); err != nil {
+		t.Fatalf("Record not found: %v", err)
+	}
+
+	checker = &Checker{Nameservers: []string{addr}, Interval: 10 * time.Millisecond, Timeout: 100 * time.Millisecond}
+	if err := checker.Wait(context.Background(), name, "other"); err == nil {
+		t.Error("Wrong value accepted")
+	}
+}
@@ -0,0 +1,246 @@
+package rfc2136
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/dnsquery"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/logger"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/solver"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Default values of the optional Config fields
+const (
+	DefaultTTL                = 60
+	DefaultPropagationTimeout = 2 * time.Minute
+	DefaultPollInterval       = 2 * time.Second
+)
+
+// tsigFudge allowed clock difference between the client and the server, in seconds (RFC 8945 section 10)
+const tsigFudge = 300
+
+// TSIGAlgorithms maps the accepted TSIG algorithm names to their miekg/dns name
+var TSIGAlgorithms = map[string]string{
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// Config configures the RFC 2136 provider.
+type Config struct {
+	// Server is the host:port of the primary name server accepting the updates
+	Server string
+	// Zone receiving the updates, discovered from the SOA records when empty
+	Zone string
+	// Resolver is the recursive resolver HOST:PORT used to follow the CNAME delegation of the challenge names, the
+	// records are published at the challenge names themselves when empty
+	Resolver string
+	// TSIGName is the name of the TSIG key, updates are unsigned when empty
+	TSIGName string
+	// TSIGAlgorithm is one of TSIGAlgorithms, hmac-sha256 when empty
+	TSIGAlgorithm string
+	// TSIGSecret is the base64 encoded TSIG secret
+	TSIGSecret string
+	// TTL of the TXT records, DefaultTTL when zero
+	TTL uint32
+	// PropagationTimeout bounds the wait for the record on the primary, DefaultPropagationTimeout when zero
+	PropagationTimeout time.Duration
+	// PollInterval between two checks of the record, DefaultPollInterval when zero
+	PollInterval time.Duration
+}
+
+// ParseTSIG parses a TSIG key written as [ALGORITHM:]NAME:SECRET, like the -y option of nsupdate.
+func ParseTSIG(value string) (string, string, string, error) {
+	parts := strings.Split(value, ":")
+	switch len(parts) {
+	case 2:
+		return "hmac-sha256", parts[0], parts[1], nil
+	case 3:
+		if _, ok := TSIGAlgorithms[strings.ToLower(parts[0])]; !ok {
+			return "", "", "", fmt.Errorf("unsupported TSIG algorithm %q", parts[0])
+		}
+		return strings.ToLower(parts[0]), parts[1], parts[2], nil
+	}
+	return "", "", "", fmt.Errorf("invalid TSIG key %q, expected [ALGORITHM:]NAME:SECRET", value)
+}
+
+// Solver answers dns-01 challenges by adding and removing the TXT records with RFC 2136 dynamic updates.
+type Solver struct {
+	cfg    Config
+	client *dns.Client
+
+	// mu protects names, the record name resolved by Present for each token, so that CleanUp removes that record
+	// even if the delegation can no longer be resolved
+	mu    sync.Mutex
+	names map[string]string
+}
+
+// New returns a Solver sending its updates as described by cfg.
+func New(cfg Config) (*Solver, error) {
+	if cfg.Server == "" {
+		return nil, errors.New("no RFC 2136 server")
+	}
+	if cfg.TSIGAlgorithm == "" {
+		cfg.TSIGAlgorithm = "hmac-sha256"
+	}
+	if _, ok := TSIGAlgorithms[cfg.TSIGAlgorithm]; !ok {
+		return nil, fmt.Errorf("unsupported TSIG algorithm %q", cfg.TSIGAlgorithm)
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = DefaultTTL
+	}
+	if cfg.PropagationTimeout == 0 {
+		cfg.PropagationTimeout = DefaultPropagationTimeout
+	}
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = DefaultPollInterval
+	}
+
+	client := new(dns.Client)
+	if cfg.TSIGName != "" {
+		cfg.TSIGName = dns.Fqdn(cfg.TSIGName)
+		client.TsigSecret = map[string]string{cfg.TSIGName: cfg.TSIGSecret}
+	}
+
+	return &Solver{cfg: cfg, client: client, names: make(map[string]string)}, nil
+}
+
+// Present adds the TXT record of the challenge on the primary and waits until the primary serves it.
+func (s *Solver) Present(ctx context.Context, domain, token, keyAuth string) error {
+	fqdn, err := s.recordName(ctx, domain)
+	if err != nil {
+		return err
+	}
+	value := solver.DNS01Value(keyAuth)
+
+	if err := s.update(ctx, fqdn, value, true); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.names[token] = fqdn
+	s.mu.Unlock()
+	logger.Logger().Debug().Msgf("RFC 2136 record added: %v TXT %v", fqdn, value)
+
+	return s.waitFor(ctx, fqdn, value)
+}
+
+// CleanUp removes the TXT record of the challenge from the primary, at the name Present published it.
+func (s *Solver) CleanUp(ctx context.Context, domain, token, keyAuth string) error {
+	s.mu.Lock()
+	fqdn, ok := s.names[token]
+	s.mu.Unlock()
+	if !ok {
+		var err error
+		if fqdn, err = s.recordName(ctx, domain); err != nil {
+			return err
+		}
+	}
+	if err := s.update(ctx, fqdn, solver.DNS01Value(keyAuth), false); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.names, token)
+	s.mu.Unlock()
+	logger.Logger().Debug().Msgf("RFC 2136 record removed: %v", fqdn)
+	return nil
+}
+
+// recordName returns the name of the TXT record of domain, following its CNAME delegation when a resolver is set.
+func (s *Solver) recordName(ctx context.Context, domain string) (string, error) {
+	fqdn := solver.DNS01Name(domain)
+	if s.cfg.Resolver == "" {
+		return fqdn, nil
+	}
+
+	_, target, err := dnsquery.Follow(ctx, s.client, s.cfg.Resolver, fqdn, dns.TypeTXT)
+	if err != nil {
+		return "", fmt.Errorf("could not follow the delegation of %v: %w", fqdn, err)
+	}
+	if target != fqdn {
+		logger.Logger().Debug().Msgf("%v is delegated to %v", fqdn, target)
+	}
+	return target, nil
+}
+
+// update adds (or removes) the TXT record fqdn with value.
+func (s *Solver) update(ctx context.Context, fqdn string, value string, add bool) error {
+	zone := s.cfg.Zone
+	if zone == "" {
+		var err error
+		if zone, err = s.findZone(ctx, fqdn); err != nil {
+			return err
+		}
+	}
+
+	rr := &dns.TXT{
+		Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: s.cfg.TTL},
+		Txt: []string{value},
+	}
+
+	msg := new(dns.Msg).SetUpdate(dns.Fqdn(zone))
+	if add {
+		msg.Insert([]dns.RR{rr})
+	} else {
+		msg.Remove([]dns.RR{rr})
+	}
+
+	res, err := s.exchange(ctx, msg)
+	if err != nil {
+		return err
+	}
+	if res.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("RFC 2136 update of %v refused: %v", fqdn, dns.RcodeToString[res.Rcode])
+	}
+	return nil
+}
+
+// exchange sends msg to the primary, signed with the TSIG key when configured.
+func (s *Solver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if s.cfg.TSIGName != "" {
+		msg.SetTsig(s.cfg.TSIGName, TSIGAlgorithms[s.cfg.TSIGAlgorithm], tsigFudge, time.Now().Unix())
+	}
+	res, _, err := s.client.ExchangeContext(ctx, msg, s.cfg.Server)
+	return res, err
+}
+
+// findZone asks the primary for the SOA of fqdn and returns the apex of the zone containing it.
+func (s *Solver) findZone(ctx context.Context, fqdn string) (string, error) {
+	res, err := s.exchange(ctx, new(dns.Msg).SetQuestion(fqdn, dns.TypeSOA))
+	if err != nil {
+		return "", err
+	}
+
+	for _, rr := range append(res.Answer, res.Ns...) {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Hdr.Name, nil
+		}
+	}
+	return "", fmt.Errorf("could not find the zone of %v on %v", fqdn, s.cfg.Server)
+}
+
+// waitFor polls the primary until it serves the TXT record fqdn with value.
+func (s *Solver) waitFor(ctx context.Context, fqdn string, value string) error {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.PropagationTimeout)
+	defer cancel()
+
+	for {
+		res, err := s.exchange(ctx, new(dns.Msg).SetQuestion(fqdn, dns.TypeTXT))
+		if err == nil {
+			for _, rr := range res.Answer {
+				if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == value {
+					return nil
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("TXT record %v not served by %v: %w", fqdn, s.cfg.Server, ctx.Err())
+		case <-time.After(s.cfg.PollInterval):
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package rfc2136
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/solver"
+)
+
+const (
+	testKey    = "acme-update."
+	testSecret = "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"
+)
+
+// updateServer is a minimal primary of example.com accepting TSIG signed updates of TXT records.
+type updateServer struct {
+	mu      sync.Mutex
+	records map[string][]string
+}
+
+func (u *updateServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg).SetReply(r)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	switch {
+	case r.Opcode == dns.OpcodeUpdate && (r.IsTsig() == nil || w.TsigStatus() != nil):
+		m.Rcode = dns.RcodeRefused
+	case r.Opcode == dns.OpcodeUpdate:
+		for _, rr := range r.Ns {
+			name, value := strings.ToLower(rr.Header().Name), strings.Join(rr.(*dns.TXT).Txt, "")
+			if rr.Header().Class == dns.ClassNONE {
+				u.records[name] = nil
+				continue
+			}
+			u.records[name] = append(u.records[name], value)
+		}
+	case r.Question[0].Qtype == dns.TypeSOA:
+		m.Ns = append(m.Ns, &dns.SOA{
+			Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+			Ns:  "ns.example.com.", Mbox: "admin.example.com.", Minttl: 60,
+		})
+	default:
+		q := r.Question[0]
+		for _, value := range u.records[strings.ToLower(q.Name)] {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{value},
+			})
+		}
+	}
+
+	if r.IsTsig() != nil {
+		m.SetTsig(testKey, dns.HmacSHA256, tsigFudge, time.Now().Unix())
+	}
+	_ = w.WriteMsg(m)
+}
+
+// txt returns the TXT values of name served by the primary.
+func (u *updateServer) txt(name string) []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string{}, u.records[name]...)
+}
+
+func TestPresentCleanUp(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := &updateServer{records: map[string][]string{}}
+	server := &dns.Server{PacketConn: pc, Handler: primary, TsigSecret: map[string]string{testKey: testSecret},
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept }}
+	go func() { _ = server.ActivateAndServe() }()
+	defer server.Shutdown()
+
+	s, err := New(Config{Server: pc.LocalAddr().String(), TSIGName: testKey, TSIGSecret: testSecret, PollInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := s.Present(ctx, "*.www.example.com", "token", "keyauth"); err != nil {
+		t.Fatalf("Present failed: %v", err)
+	}
+	if got := primary.txt("_acme-challenge.www.example.com."); len(got) != 1 || got[0] != solver.DNS01Value("keyauth") {
+		t.Errorf("Wrong records after Present: %v", got)
+	}
+
+	if err := s.CleanUp(ctx, "*.www.example.com", "token", "keyauth"); err != nil {
+		t.Fatalf("CleanUp failed: %v", err)
+	}
+	if got := primary.txt("_acme-challenge.www.example.com."); len(got) != 0 {
+		t.Errorf("Records left after CleanUp: %v", got)
+	}
+
+	unsigned, _ := New(Config{Server: pc.LocalAddr().String(), Zone: "example.com"})
+	if err := unsigned.Present(ctx, "www.example.com", "token", "keyauth"); err == nil {
+		t.Error("Unsigned update accepted")
+	}
+}
+
+func TestParseTSIG(t *testing.T) {
+	alg, name, secret, err := ParseTSIG("HMAC-SHA512:key:c2VjcmV0")
+	if err != nil || alg != "hmac-sha512" || name != "key" || secret != "c2VjcmV0" {
+		t.Errorf("Wrong TSIG key: %v %v %v %v", alg, name, secret, err)
+	}
+	if alg, _, _, _ := ParseTSIG("key:c2VjcmV0"); alg != "hmac-sha256" {
+		t.Errorf("Wrong default algorithm: %v", alg)
+	}
+	if _, _, _, err := ParseTSIG("hmac-md5:key:c2VjcmV0"); err == nil {
+		t.Error("Unsupported algorithm accepted")
+	}
+}
+
+func TestCleanUpDelegated(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := &updateServer{records: map[string][]string{}}
+	server := &dns.Server{PacketConn: pc, Handler: primary, TsigSecret: map[string]string{testKey: testSecret},
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept }}
+	go func() { _ = server.ActivateAndServe() }()
+	defer server.Shutdown()
+
+	// the resolver delegates the challenge name until it fails
+	var failing atomic.Bool
+	rpc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := &dns.Server{PacketConn: rpc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg).SetReply(r)
+		if failing.Load() {
+			m.Rcode = dns.RcodeServerFailure
+		} else if r.Question[0].Name == "_acme-challenge.www.example.com." {
+			m.Answer = append(m.Answer, &dns.CNAME{
+				Hdr:    dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+				Target: "www.acme.example.com.",
+			})
+		}
+		_ = w.WriteMsg(m)
+	})}
+	go func() { _ = resolver.ActivateAndServe() }()
+	defer resolver.Shutdown()
+
+	s, err := New(Config{Server: pc.LocalAddr().String(), Zone: "example.com", Resolver: rpc.LocalAddr().String(),
+		TSIGName: testKey, TSIGSecret: testSecret, PollInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := s.Present(ctx, "www.example.com", "token", "keyauth"); err != nil {
+		t.Fatalf("Present failed: %v", err)
+	}
+	if got := primary.txt("www.acme.example.com."); len(got) != 1 {
+		t.Errorf("Delegated record not added: %v", got)
+	}
+
+	failing.Store(true)
+	if err := s.CleanUp(ctx, "www.example.com", "token", "keyauth"); err != nil {
+		t.Fatalf("CleanUp failed: %v", err)
+	}
+	if got := primary.txt("www.acme.example.com."); len(got) != 0 {
+		t.Errorf("Records left after CleanUp: %v", got)
+	}
+	if err := s.CleanUp(ctx, "www.example.com", "token", "keyauth"); err == nil {
+		t.Error("Forgotten name cleaned up without resolver")
+	}
+}
@@ -0,0 +1,89 @@
+package solver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"sync"
+)
+
+// Challenge types as named by the ACME protocol
+const (
+	TypeDNS01  = "dns-01"
+	TypeHTTP01 = "http-01"
+)
+
+// Solver answers one type of ACME challenge.
+type Solver interface {
+	// Present publishes the key authorization of the challenge token so that the ACME server can validate domain.
+	Present(ctx context.Context, domain, token, keyAuth string) error
+	// CleanUp removes what Present published once the authorization is finished.
+	CleanUp(ctx context.Context, domain, token, keyAuth string) error
+}
+
+// Registry maps a challenge type to the Solver answering it.
+type Registry struct {
+	mu      sync.RWMutex
+	solvers map[string]Solver
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{solvers: make(map[string]Solver)}
+}
+
+// Register sets s as the Solver of challengeType, replacing any previous one.
+func (r *Registry) Register(challengeType string, s Solver) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.solvers[challengeType] = s
+}
+
+// Get returns the Solver of challengeType.
+func (r *Registry) Get(challengeType string) (Solver, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.solvers[challengeType]
+	return s, ok
+}
+
+// ChallengeType converts the command line names (dns01, http01) to the ACME challenge types. ACME names are
+// returned unchanged, unknown names are returned as an empty string.
+func ChallengeType(name string) string {
+	switch name {
+	case "dns01", TypeDNS01:
+		return TypeDNS01
+	case "http01", TypeHTTP01:
+		return TypeHTTP01
+	}
+	return ""
+}
+
+// ValidToken tells whether token is a non-empty base64url string, as ACME tokens are (RFC 8555 section 8.1). Tokens
+// come from the ACME server and must be checked before being used in paths.
+func ValidToken(token string) bool {
+	if token == "" {
+		return false
+	}
+	for _, c := range token {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// DNS01Value returns the TXT record value of a dns-01 challenge: the base64url encoded SHA-256 digest of the key
+// authorization (RFC 8555 section 8.4).
+func DNS01Value(keyAuth string) string {
+	hash := sha256.Sum256([]byte(keyAuth))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// DNS01Name returns the fully qualified name of the TXT record of a dns-01 challenge. Wildcard identifiers are
+// validated on their base name.
+func DNS01Name(domain string) string {
+	domain = strings.TrimPrefix(domain, "*.")
+	return "_acme-challenge." + strings.TrimSuffix(domain, ".") + "."
+}
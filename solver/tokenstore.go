@@ -0,0 +1,158 @@
+package solver
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultTokenTTL is how long a token is kept when Present is called without a context deadline
+const DefaultTokenTTL = 1 * time.Hour
+
+// Token is a challenge response published for one domain.
+type Token struct {
+	Domain  string
+	Token   string
+	Value   string
+	Expires time.Time
+}
+
+// TokenStore keeps the published challenge responses, keyed by domain and token, until they are removed or expire.
+// They can be looked up by domain or by token in constant time. It is safe for concurrent use.
+type TokenStore struct {
+	mu      sync.RWMutex
+	entries map[string]map[string]Token
+	// byToken indexes the entries by token, then domain
+	byToken map[string]map[string]Token
+}
+
+// NewTokenStore returns an empty TokenStore.
+func NewTokenStore() *TokenStore {
+	return &TokenStore{
+		entries: make(map[string]map[string]Token),
+		byToken: make(map[string]map[string]Token),
+	}
+}
+
+// unindex removes the token of domain from byToken.
+func (s *TokenStore) unindex(domain, token string) {
+	delete(s.byToken[token], domain)
+	if len(s.byToken[token]) == 0 {
+		delete(s.byToken, token)
+	}
+}
+
+// Add publishes t, replacing a previous value for the same domain and token.
+func (s *TokenStore) Add(t Token) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.entries[t.Domain] == nil {
+		s.entries[t.Domain] = make(map[string]Token)
+	}
+	s.entries[t.Domain][t.Token] = t
+
+	if s.byToken[t.Token] == nil {
+		s.byToken[t.Token] = make(map[string]Token)
+	}
+	s.byToken[t.Token][t.Domain] = t
+}
+
+// Remove deletes the token of domain and reports whether it was present.
+func (s *TokenStore) Remove(domain, token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.entries[domain][token]; !ok {
+		return false
+	}
+	delete(s.entries[domain], token)
+	if len(s.entries[domain]) == 0 {
+		delete(s.entries, domain)
+	}
+	s.unindex(domain, token)
+	return true
+}
+
+// RemoveExpired deletes the tokens that expired before now and returns them.
+func (s *TokenStore) RemoveExpired(now time.Time) []Token {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var removed []Token
+	for domain, tokens := range s.entries {
+		for token, t := range tokens {
+			if !t.Expires.IsZero() && t.Expires.Before(now) {
+				removed = append(removed, t)
+				delete(tokens, token)
+				s.unindex(domain, token)
+			}
+		}
+		if len(tokens) == 0 {
+			delete(s.entries, domain)
+		}
+	}
+	return removed
+}
+
+// RemoveAll empties the store and returns the removed tokens.
+func (s *TokenStore) RemoveAll() []Token {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var removed []Token
+	for _, tokens := range s.entries {
+		for _, t := range tokens {
+			removed = append(removed, t)
+		}
+	}
+	s.entries = make(map[string]map[string]Token)
+	s.byToken = make(map[string]map[string]Token)
+	return removed
+}
+
+// Domain returns the tokens published for domain.
+func (s *TokenStore) Domain(domain string) []Token {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var tokens []Token
+	for _, t := range s.entries[domain] {
+		tokens = append(tokens, t)
+	}
+	return tokens
+}
+
+// Token returns the entries published for token, one per domain.
+func (s *TokenStore) Token(token string) []Token {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var tokens []Token
+	for _, t := range s.byToken[token] {
+		tokens = append(tokens, t)
+	}
+	return tokens
+}
+
+// All returns every published token.
+func (s *TokenStore) All() []Token {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var tokens []Token
+	for _, domainTokens := range s.entries {
+		for _, t := range domainTokens {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+// ExpiryFromContext returns the deadline of ctx, or DefaultTokenTTL from now when ctx has none.
+func ExpiryFromContext(ctx context.Context) time.Time {
+	if deadline, ok := ctx.Deadline(); ok {
+		return deadline
+	}
+	return time.Now().Add(DefaultTokenTTL)
+}
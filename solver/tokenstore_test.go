@@ -0,0 +1,34 @@
+package solver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenStore(t *testing.T) {
+	store := NewTokenStore()
+	now := time.Now()
+
+	store.Add(Token{Domain: "example.com", Token: "a", Value: "1", Expires: now.Add(time.Minute)})
+	store.Add(Token{Domain: "example.com", Token: "b", Value: "2", Expires: now.Add(-time.Minute)})
+	store.Add(Token{Domain: "example.org", Token: "c", Value: "3", Expires: now.Add(time.Minute)})
+
+	if len(store.Domain("example.com")) != 2 {
+		t.Errorf("Expected 2 tokens for example.com")
+	}
+
+	if removed := store.RemoveExpired(now); len(removed) != 1 || removed[0].Token != "b" {
+		t.Errorf("Wrong expired tokens: %v", removed)
+	}
+	if len(store.Token("b")) != 0 || len(store.Token("c")) != 1 {
+		t.Errorf("Wrong token index after expiry")
+	}
+
+	if !store.Remove("example.com", "a") || store.Remove("example.com", "a") || len(store.Token("a")) != 0 {
+		t.Errorf("Token a should be removed exactly once")
+	}
+
+	if removed := store.RemoveAll(); len(removed) != 1 || len(store.All()) != 0 {
+		t.Errorf("RemoveAll did not empty the store: %v", removed)
+	}
+}
@@ -0,0 +1,107 @@
+package webroot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/logger"
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-acme/netsec-2024-acme/netzuser-acme-project/solver"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// challengeDir directory of the challenge files, relative to the webroot (RFC 8555 section 8.3)
+const challengeDir = ".well-known/acme-challenge"
+
+// Permissions of the created files and directories, readable by the web server
+const (
+	filePerm fs.FileMode = 0644
+	dirPerm  fs.FileMode = 0755
+)
+
+// Solver answers http-01 challenges by writing the key authorizations into the document root of a web server that
+// already serves the domains on port 80.
+type Solver struct {
+	// Default is the webroot of the domains without their own entry, none when empty
+	Default string
+	// PerDomain maps lower case identifiers to their webroot
+	PerDomain map[string]string
+}
+
+// ParseWebroot parses a webroot written as [DOMAIN=]PATH, the domain is empty for the default webroot.
+func ParseWebroot(value string) (string, string, error) {
+	domain, path, found := strings.Cut(value, "=")
+	if !found {
+		domain, path = "", value
+	}
+	if path == "" {
+		return "", "", fmt.Errorf("invalid webroot %q, expected [DOMAIN=]PATH", value)
+	}
+	return strings.ToLower(domain), path, nil
+}
+
+// path returns the location of the challenge file of token for domain.
+func (s Solver) path(domain, token string) (string, error) {
+	if !solver.ValidToken(token) {
+		return "", fmt.Errorf("invalid token %q", token)
+	}
+	root, ok := s.PerDomain[strings.ToLower(domain)]
+	if !ok {
+		root = s.Default
+	}
+	if root == "" {
+		return "", errors.New("no webroot configured for " + domain)
+	}
+	return filepath.Join(root, challengeDir, token), nil
+}
+
+// Present writes keyAuth to the challenge file of token. The file is written under a temporary name and renamed, so
+// that the web server never serves a partial key authorization.
+func (s Solver) Present(_ context.Context, domain, token, keyAuth string) error {
+	path, err := s.path(domain, token)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), dirPerm); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".acme-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(keyAuth); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(filePerm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	logger.Logger().Debug().Msgf("Challenge file written for %v: %v", domain, path)
+	return nil
+}
+
+// CleanUp deletes the challenge file of token.
+func (s Solver) CleanUp(_ context.Context, domain, token, _ string) error {
+	path, err := s.path(domain, token)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	logger.Logger().Debug().Msgf("Challenge file removed for %v: %v", domain, path)
+	return nil
+}
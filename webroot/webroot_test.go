@@ -0,0 +1,43 @@
+package webroot
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPresentCleanUp(t *testing.T) {
+	root, other := t.TempDir(), t.TempDir()
+	s := Solver{Default: root, PerDomain: map[string]string{"other.example.com": other}}
+	ctx := context.Background()
+
+	if err := s.Present(ctx, "Other.example.com", "token", "token.thumb"); err != nil {
+		t.Fatalf("Present failed: %v", err)
+	}
+	path := filepath.Join(other, ".well-known", "acme-challenge", "token")
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != filePerm {
+		t.Fatalf("Wrong challenge file: %v %v", info, err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "token.thumb" {
+		t.Errorf("Wrong key authorization: %q", data)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("Temporary files left: %v", entries)
+	}
+
+	if err := s.CleanUp(ctx, "other.example.com", "token", "token.thumb"); err != nil {
+		t.Fatalf("CleanUp failed: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Challenge file not removed: %v", err)
+	}
+
+	if err := s.Present(ctx, "example.com", "../../escape", "x"); err == nil {
+		t.Error("Token with a path accepted")
+	}
+	if err := (Solver{}).Present(ctx, "example.com", "token", "x"); err == nil {
+		t.Error("Domain without webroot accepted")
+	}
+}